@@ -3,6 +3,9 @@ package main
 import (
 	"fmt"
 	"os"
+	"net"
+	"errors"
+	"encoding/json"
 	"os/exec"
 	"flag"
 	"sync"
@@ -12,16 +15,25 @@ import (
 	"unicode/utf8"
 	"regexp"
 	"sort"
+	"syscall"
 	"github.com/nsf/termbox-go"
 )
 
 var SuffixIn string       = "/in"
+var SuffixSocket string   = "/socket"
+var SuffixLock string     = "/lock"
 var SuffixPlaylist string = "/playlist"
 var SuffixUpcoming string = "/upcoming"
 var SuffixVolume string   = "/volume"
 var SuffixPlaying string  = "/playing"
 var SuffixIsRandom string = "/israndom"
 var SuffixIsPaused string = "/ispaused"
+var SuffixIsMuted string  = "/ismuted"
+var SuffixPosition string = "/position"
+var SuffixMetadata string = "/metadata"
+var SuffixIsRepeatOne string = "/isrepeatone"
+var SuffixIsOnce string   = "/isonce"
+var SuffixIsStopAfter string = "/isstopafter"
 
 type Line struct {
 	Value string
@@ -40,6 +52,7 @@ var ctrlKeys = map[termbox.Key](func()) {
 	termbox.KeyArrowDown: moveNext,
 	termbox.KeyArrowUp: movePrev,
 	termbox.KeyArrowRight: next,
+	termbox.KeyArrowLeft: prev,
 	termbox.KeyPgdn: pageDown,
 	termbox.KeyPgup: pageUp,
 	termbox.KeyCtrlF: pageDown,
@@ -55,6 +68,7 @@ var normKeys = map[rune](func()) {
 	'a': addUpcoming,
 	'A': addTopUpcoming,
 	'l': next,
+	'h': prev,
 	'p': togglePause,
 	'r': toggleRandom,
 	'R': refresh,
@@ -72,6 +86,7 @@ var normKeys = map[rune](func()) {
 	'c': gotoPlaying,
 	'+': increaseVolume,
 	'-': decreaseVolume,
+	'm': toggleMute,
 }
 
 var lock *sync.Mutex
@@ -119,8 +134,12 @@ func startMMusic(playlist string) {
 func playCursor() {
 	if cursor != nil {
 		if currentView == ViewPlaylists {
-			writeToIn("exit")
-			startMMusic(playlistDir + "/" + cursor.Value)
+			playlist := playlistDir + "/" + cursor.Value
+			if running() {
+				sendCommand("load", playlist)
+			} else {
+				startMMusic(playlist)
+			}
 			time.Sleep(100000000)
 			refresh()
 			viewPlaylist()
@@ -178,33 +197,46 @@ func addTopUpcoming() {
 }
 
 func next() {
-	writeToIn("next")
+	sendCommand("next")
+}
+
+func prev() {
+	sendCommand("prev")
 }
 
 func togglePause() {
 	_, err := os.Stat(tmp + SuffixIsPaused)
 	if err == nil {
-		writeToIn("resume")
+		sendCommand("resume")
 	} else {
-		writeToIn("pause")
+		sendCommand("pause")
 	}
 }
 
 func toggleRandom() {
 	_, err := os.Stat(tmp + SuffixIsRandom)
 	if err == nil {
-		writeToIn("normal")
+		sendCommand("normal")
 	} else {
-		writeToIn("random")
+		sendCommand("random")
 	}
 }
 
 func increaseVolume() {
-	writeToIn("increase")
+	sendCommand("increase")
 }
 
 func decreaseVolume() {
-	writeToIn("decrease")
+	sendCommand("decrease")
+}
+
+func toggleMute() {
+	_, err := os.Stat(tmp + SuffixIsMuted)
+	if err == nil {
+		sendCommand("unmute")
+	} else {
+		sendCommand("mute")
+	}
 }
 
 func search() {
@@ -402,6 +434,58 @@ func pageUp() {
 	}
 }
 
+/* Whether mmusic is running, it holds a lock on $tmp/lock for as long
+ * as it does. */
+func running() bool {
+	f, err := os.Open(tmp + SuffixLock)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH | syscall.LOCK_NB)
+	if err == nil {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		return false
+	}
+	return true
+}
+
+/* Sends a command to mmusic over its socket, or if it doesn't have one
+ * writes it to in. Returns mmusic's error if it gives one. */
+func sendCommand(command string, args ...string) error {
+	conn, err := net.Dial("unix", tmp + SuffixSocket)
+	if err != nil {
+		line := command
+		for _, arg := range args {
+			line += " " + quoteArg(arg)
+		}
+		writeToIn(line + "\n")
+		return nil
+	}
+	defer conn.Close()
+	
+	err = json.NewEncoder(conn).Encode(map[string]interface{}{
+		"command": command,
+		"args": args,
+	})
+	if err != nil {
+		return err
+	}
+	
+	var reply struct {
+		Status string
+		Error string
+	}
+	err = json.NewDecoder(conn).Decode(&reply)
+	if err != nil {
+		return err
+	} else if reply.Status != "ok" {
+		return errors.New(reply.Error)
+	}
+	return nil
+}
+
 func writeToIn(code string) {
 	in, err := os.OpenFile(tmp + SuffixIn, os.O_WRONLY, os.ModeNamedPipe)
 	if err == nil {
@@ -410,6 +494,11 @@ func writeToIn(code string) {
 	}
 }
 
+/* Quotes arg for mmusic's command line. */
+func quoteArg(arg string) string {
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
 func putString(str string, x, y int, fg, bg termbox.Attribute) {
 	len := 0
 	i := 0
@@ -446,7 +535,30 @@ func drawBar() {
 		f.Close()
 	}
 	
+	f, err = os.Open(tmp + SuffixIsMuted)
+	if err == nil {
+		termbox.SetCell(2, bottom, 'M', fg, bg)
+		f.Close()
+	}
+	
+	if _, err = os.Stat(tmp + SuffixIsStopAfter); err == nil {
+		termbox.SetCell(3, bottom, 'S', fg, bg)
+	} else if _, err = os.Stat(tmp + SuffixIsRepeatOne); err == nil {
+		termbox.SetCell(3, bottom, '1', fg, bg)
+	} else if _, err = os.Stat(tmp + SuffixIsOnce); err == nil {
+		termbox.SetCell(3, bottom, 'O', fg, bg)
+	}
+	
 	playing := getPlaying()
+	metadata := getMetadata()
+	if metadata["artist"] != "" && metadata["title"] != "" {
+		playing = metadata["artist"] + " - " + metadata["title"]
+	}
+	
+	position := getPosition()
+	if position != "" {
+		playing = position + " " + playing
+	}
 	putString(playing, 4, bottom, fg, bg)
 		
 	f, err = os.Open(tmp + SuffixVolume)
@@ -620,6 +732,49 @@ func getPlaying() string {
 	return string(data[:n-1])
 }
 
+func getMetadata() map[string]string {
+	metadata := make(map[string]string)
+	
+	data, err := ioutil.ReadFile(tmp + SuffixMetadata)
+	if err != nil {
+		return metadata
+	}
+	
+	for _, line := range strings.Split(string(data), "\n") {
+		i := strings.Index(line, "=")
+		if i > 0 {
+			metadata[line[:i]] = line[i+1:]
+		}
+	}
+	return metadata
+}
+
+func formatTime(secs int) string {
+	if secs >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d",
+		                   secs / 3600, (secs / 60) % 60, secs % 60)
+	}
+	return fmt.Sprintf("%d:%02d", secs / 60, secs % 60)
+}
+
+func getPosition() string {
+	var elapsed, total int
+	
+	data, err := ioutil.ReadFile(tmp + SuffixPosition)
+	if err != nil {
+		return ""
+	}
+	
+	n, _ := fmt.Sscan(string(data), &elapsed, &total)
+	if n == 0 {
+		return ""
+	} else if total <= 0 {
+		return formatTime(elapsed)
+	}
+	
+	return formatTime(elapsed) + "/" + formatTime(total)
+}
+
 func scan(path string) *Line {
 	var f, l *Line
 	var n, i int
@@ -695,6 +850,10 @@ func readPlaylists() *Line {
 	lines := new(Line)
 	l := lines
 	for _, playlist := range playlists {
+		/* mmusic's config lives here too. */
+		if playlist == "mmusic.conf" {
+			continue
+		}
 		l.Next = new(Line)
 		l.Next.Prev = l
 		l = l.Next
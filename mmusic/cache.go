@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/gob"
+	"os"
+	"path"
+	"sort"
+)
+
+/* Directory listings kept between runs so directories that haven't
+ * changed don't need reading again. A listing is used for as long as
+ * the directory's mtime stays the same. */
+
+type dirEntry struct {
+	Name string
+	IsDir bool
+}
+
+type cachedDir struct {
+	ModTime int64
+	Entries []dirEntry
+}
+
+type LibraryCache struct {
+	path string
+	dirs map[string]*cachedDir
+	dirty bool
+}
+
+/* Set in main, nil when there is no cache. */
+var libraryCache *LibraryCache
+
+func defaultCachePath() string {
+	dir := os.Getenv("XDG_CACHE_HOME")
+	if dir == "" {
+		dir = os.Getenv("HOME") + "/.cache"
+	}
+	return dir + "/mmusic/library"
+}
+
+/* Loads the cache at path, starting a new one if it can't be read or
+ * rebuild is set. */
+func OpenLibraryCache(path string, rebuild bool) *LibraryCache {
+	c := &LibraryCache{path: path, dirs: make(map[string]*cachedDir)}
+	if rebuild {
+		c.dirty = true
+		return c
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return c
+	}
+	defer file.Close()
+
+	err = gob.NewDecoder(file).Decode(&c.dirs)
+	if err != nil || c.dirs == nil {
+		c.dirs = make(map[string]*cachedDir)
+		c.dirty = true
+	}
+	return c
+}
+
+func (c *LibraryCache) Save() error {
+	if !c.dirty {
+		return nil
+	}
+
+	err := os.MkdirAll(path.Dir(c.path), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := c.path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	err = gob.NewEncoder(file).Encode(c.dirs)
+	file.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	c.dirty = false
+	return os.Rename(tmpPath, c.path)
+}
+
+func (c *LibraryCache) ReadDir(dir string) ([]dirEntry, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		if _, ok := c.dirs[dir]; ok {
+			delete(c.dirs, dir)
+			c.dirty = true
+		}
+		return nil, err
+	}
+
+	modTime := fi.ModTime().UnixNano()
+	cached, ok := c.dirs[dir]
+	if ok && cached.ModTime == modTime {
+		return cached.Entries, nil
+	}
+
+	entries, err := listDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	c.dirs[dir] = &cachedDir{modTime, entries}
+	c.dirty = true
+	return entries, nil
+}
+
+/* Sorted entries of dir, symlinks are followed to see if they lead to
+ * directories. */
+func listDir(dir string) ([]dirEntry, error) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	infos, err := file.Readdir(0)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]dirEntry, len(infos))
+	for i, fi := range infos {
+		if fi.Mode() & os.ModeSymlink != 0 {
+			target, err := os.Stat(dir + "/" + fi.Name())
+			if err == nil {
+				fi = target
+			}
+		}
+		entries[i] = dirEntry{infos[i].Name(), fi.IsDir()}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
+
+func readDir(dir string) ([]dirEntry, error) {
+	if libraryCache != nil {
+		return libraryCache.ReadDir(dir)
+	}
+	return listDir(dir)
+}
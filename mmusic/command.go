@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+/* Splits a command line in to its arguments. Arguments are separated by
+ * spaces or tabs and can be quoted to include them: inside "double
+ * quotes" a backslash escapes the next character, inside 'single quotes'
+ * everything is taken as it is. Outside quotes a backslash escapes the
+ * next character too. */
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	/* Whether there is an argument, it may be "". */
+	inArg := false
+	var quote rune
+	escaped := false
+
+	for _, c := range line {
+		switch {
+		case escaped:
+			arg.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				arg.WriteRune(c)
+			}
+		case c == '\\':
+			escaped = true
+			inArg = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				arg.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+
+	if escaped {
+		return nil, errors.New("backslash at end of line")
+	} else if quote != 0 {
+		return nil, errors.New("unterminated " + string(quote) + " quote")
+	}
+
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
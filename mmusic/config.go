@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/* Settings read from $XDG_CONFIG_HOME/mmusic/mmusic.conf, one
+ * "key = value" per line with # starting a comment:
+ *
+ *     sink = pulsesink
+ *     sink.device = alsa_output.usb
+ *     volume = 60
+ *     playlist = /home/me/.config/mmusic/everything
+ *
+ * Most keys stand in for a flag (see configFlags), flags given on the
+ * command line win. sink.NAME sets a property on the sink and playlist,
+ * which can be given more than once, is used when no playlist files are
+ * given as arguments. */
+
+/* Config keys and the flags they set. */
+var configFlags = map[string]string{
+	"tmp": "t",
+	"sink": "l",
+	"random": "r",
+	"volume": "v",
+	"crossfade": "x",
+	"index": "i",
+	"cache": "c",
+	"types": "types",
+	"watch": "w",
+	"mpd": "mpd",
+	"http": "http",
+	"mpris": "mpris",
+	"state": "s",
+	"resume": "resume",
+	"log": "log",
+}
+
+/* Keys reload-config applies, the rest only take effect on a restart. */
+var runtimeConfig = []string{"crossfade", "types", "log"}
+
+type sinkProperty struct {
+	name string
+	value string
+}
+
+type Config struct {
+	/* By key, for those in configFlags. */
+	values map[string]string
+	sinkProps []sinkProperty
+	playlists []string
+}
+
+func defaultConfigPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = os.Getenv("HOME") + "/.config"
+	}
+	return dir + "/mmusic/mmusic.conf"
+}
+
+/* Reads the config file at name, a missing file is an empty config. */
+func readConfig(name string) (*Config, error) {
+	c := &Config{values: make(map[string]string)}
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", name, n)
+		}
+
+		key := strings.TrimSpace(kv[0])
+		value := strings.TrimSpace(kv[1])
+		if strings.HasPrefix(key, "sink.") {
+			c.sinkProps = append(c.sinkProps,
+			                     sinkProperty{key[len("sink."):], value})
+		} else if key == "playlist" {
+			c.playlists = append(c.playlists, value)
+		} else if _, ok := configFlags[key]; ok {
+			c.values[key] = value
+		} else {
+			return nil, fmt.Errorf("%s:%d: unknown key %q", name, n, key)
+		}
+	}
+	return c, scanner.Err()
+}
+
+/* The flags given on the command line. */
+func explicitFlags() map[string]bool {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
+
+/* Sets the flags for the keys in c, leaving those in explicit alone. */
+func (c *Config) setFlags(explicit map[string]bool) error {
+	for key, value := range c.values {
+		name := configFlags[key]
+		if explicit[name] {
+			continue
+		}
+
+		err := flag.Set(name, value)
+		if err != nil {
+			return fmt.Errorf("config: %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+/* Property values are strings in the file, guess what the sink wants
+ * from what they look like. Quoting a value keeps it a string. */
+func propertyValue(value string) interface{} {
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) &&
+	   strings.HasSuffix(value, `"`) {
+		return value[1:len(value)-1]
+	} else if i, err := strconv.Atoi(value); err == nil {
+		return i
+	} else if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return f
+	} else if value == "true" || value == "false" {
+		return value == "true"
+	}
+	return value
+}
+
+/* Sends the log to the file name, or stderr if it is empty. */
+func (p *Player) setLog(name string) error {
+	var file *os.File
+	if name != "" {
+		var err error
+		file, err = os.OpenFile(name,
+		                        os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(file)
+	} else {
+		log.SetOutput(os.Stderr)
+	}
+
+	if p.logFile != nil {
+		p.logFile.Close()
+	}
+	p.logFile = file
+	return nil
+}
+
+/* Reads the config file again and applies what can be changed while
+ * running. Keys left out go back to their defaults, flags given on the
+ * command line still win. */
+func (p *Player) ReloadConfig() error {
+	if p.configPath == "" {
+		return fmt.Errorf("reload-config: no config file")
+	}
+
+	c, err := readConfig(p.configPath)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range runtimeConfig {
+		name := configFlags[key]
+		if p.explicit[name] {
+			continue
+		}
+
+		value, ok := c.values[key]
+		if !ok {
+			value = flag.Lookup(name).DefValue
+		}
+
+		switch key {
+		case "crossfade":
+			secs, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("config: crossfade: invalid length %q", value)
+			}
+			p.SetCrossfade(secs)
+		case "types":
+			SetAudioTypes(value)
+		case "log":
+			err = p.setLog(value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	log.Println("reloaded", p.configPath)
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+)
+
+/* What changed, for anything that wants to know without polling the
+ * files in tmp. The names are the ones MPD uses for its idle command. */
+const (
+	/* Started, stopped, paused, seeked, or the song or its tags changed. */
+	EventPlayer = "player"
+	/* Volume or mute. */
+	EventMixer = "mixer"
+	/* Random, repeat, stop after or crossfade. */
+	EventOptions = "options"
+	/* What is playing and upcoming. */
+	EventPlaylist = "playlist"
+	/* The library. */
+	EventDatabase = "database"
+)
+
+/* Returns a channel that gets the name of each event from now on. Like
+ * everything else it must be called from Run, use Call. Events are
+ * dropped rather than waiting for a subscriber that isn't keeping up. */
+func (p *Player) Subscribe() chan string {
+	c := make(chan string, 16)
+	if p.subscribers == nil {
+		p.subscribers = make(map[chan string]bool)
+	}
+	p.subscribers[c] = true
+	return c
+}
+
+func (p *Player) Unsubscribe(c chan string) {
+	delete(p.subscribers, c)
+}
+
+func (p *Player) notify(event string) {
+	for c := range p.subscribers {
+		select {
+		case c <- event:
+		default:
+		}
+	}
+}
+
+/* upcoming is changed by other programs, check it every so often. */
+func (p *Player) checkUpcoming() {
+	fi, err := os.Stat(p.tmpDir + SuffixUpcoming)
+	if err != nil {
+		return
+	}
+
+	stamp := fi.ModTime().UnixNano() ^ fi.Size()
+	if stamp != p.upcomingStamp {
+		p.upcomingStamp = stamp
+		p.notify(EventPlaylist)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+/* Lines in playlist files starting with '!' exclude songs. What follows
+ * the '!' is either
+ *
+ *     ~regexp     songs matching the regular expression anywhere,
+ *                 the ~ can be left out if it starts with flags as in
+ *                 (?i),
+ *     a glob      if it has any of *?[ in it, with * matching across
+ *                 directories too,
+ *     a prefix    otherwise.
+ */
+type Exclusion struct {
+	prefix string
+	re *regexp.Regexp
+}
+
+/* Flags at the start of a regexp, like (?i). */
+var regexpFlags = regexp.MustCompile(`^\(\?[imsU]+\)`)
+
+func globToRegexp(glob string) string {
+	var re string
+	inClass := false
+	for i, c := range glob {
+		switch {
+		case inClass:
+			if c == ']' {
+				inClass = false
+			} else if c == '!' && glob[i-1] == '[' {
+				/* [!abc] */
+				c = '^'
+			}
+			re += string(c)
+		case c == '*':
+			re += ".*"
+		case c == '?':
+			re += "."
+		case c == '[':
+			inClass = true
+			re += "["
+		default:
+			re += regexp.QuoteMeta(string(c))
+		}
+	}
+	return "^" + re + "$"
+}
+
+/* line is without the '!'. */
+func ParseExclusion(line string) (*Exclusion, error) {
+	var err error
+	e := new(Exclusion)
+
+	if strings.HasPrefix(line, "~") {
+		e.re, err = regexp.Compile(line[1:])
+	} else if regexpFlags.MatchString(line) {
+		e.re, err = regexp.Compile(line)
+	} else if strings.ContainsAny(line, "*?[") {
+		e.re, err = regexp.Compile(globToRegexp(line))
+	} else {
+		e.prefix = line
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *Exclusion) Match(value string) bool {
+	if e.re != nil {
+		return e.re.MatchString(value)
+	}
+	return strings.HasPrefix(value, e.prefix)
+}
+
+/* Removes songs matching any of exclusions, returning how many were. */
+func exclude(songs *Song, exclusions []*Exclusion) int {
+	removed := 0
+	if len(exclusions) == 0 {
+		return removed
+	}
+
+	prev := songs
+	for s := songs.Next; s != nil; s = s.Next {
+		excluded := false
+		for _, e := range exclusions {
+			if e.Match(s.Value) {
+				excluded = true
+				break
+			}
+		}
+
+		if excluded {
+			prev.Next = s.Next
+			removed++
+		} else {
+			prev = s
+		}
+	}
+	return removed
+}
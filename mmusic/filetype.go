@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strings"
+)
+
+/* Working out which files found in directories are audio, first by
+ * extension then if that doesn't settle it by looking at the start of
+ * the file. */
+
+/* Types that are added to the library, by extension. Set with -types. */
+var AudioTypes = map[string]bool{}
+
+var DefaultAudioTypes = "mp3,ogg,oga,opus,flac,m4a,aac,wav,aiff,wma,ape,wv,mpc,mka"
+
+/* Never worth opening to check. */
+var notAudio = map[string]bool{
+	"jpg": true, "jpeg": true, "png": true, "gif": true, "bmp": true,
+	"txt": true, "nfo": true, "cue": true, "log": true, "pdf": true,
+	"m3u": true, "m3u8": true, "pls": true, "xspf": true, "sfv": true,
+	"md5": true, "db": true, "ini": true, "accurip": true,
+}
+
+/* Other names for the types in AudioTypes. */
+var typeAliases = map[string]string{
+	"aif": "aiff",
+	"aifc": "aiff",
+	"mp4": "m4a",
+	"m4b": "m4a",
+	"spx": "ogg",
+}
+
+type ScanSummary struct {
+	Rejected []string
+	/* Songs removed by '!' lines. */
+	Excluded int
+	/* Directories that were expanded. */
+	Dirs []string
+}
+
+func SetAudioTypes(list string) {
+	AudioTypes = make(map[string]bool)
+	for _, t := range strings.Split(list, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t != "" {
+			AudioTypes[strings.TrimPrefix(t, ".")] = true
+		}
+	}
+}
+
+func extType(name string) string {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+	alias, ok := typeAliases[ext]
+	if ok {
+		return alias
+	}
+	return ext
+}
+
+/* Returns the type of the file from its first few bytes, or "". */
+func sniffType(name string) string {
+	file, err := os.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	head := make([]byte, 36)
+	n, _ := file.Read(head)
+	head = head[:n]
+
+	switch {
+	case n < 4:
+		return ""
+	case bytes.HasPrefix(head, []byte("ID3")),
+	     head[0] == 0xff && head[1] & 0xe0 == 0xe0 && head[1] & 0x06 != 0:
+		/* An ID3 tag or an mpeg audio frame. */
+		return "mp3"
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return "flac"
+	case bytes.HasPrefix(head, []byte("OggS")):
+		if bytes.Contains(head, []byte("OpusHead")) {
+			return "opus"
+		}
+		return "ogg"
+	case n >= 12 && bytes.Equal(head[4:8], []byte("ftyp")):
+		return "m4a"
+	case n >= 12 && bytes.HasPrefix(head, []byte("RIFF")) &&
+	     bytes.Equal(head[8:12], []byte("WAVE")):
+		return "wav"
+	case n >= 12 && bytes.HasPrefix(head, []byte("FORM")) &&
+	     (bytes.Equal(head[8:12], []byte("AIFF")) ||
+	      bytes.Equal(head[8:12], []byte("AIFC"))):
+		return "aiff"
+	case bytes.HasPrefix(head, []byte{0x30, 0x26, 0xb2, 0x75}):
+		return "wma"
+	case bytes.HasPrefix(head, []byte("MAC ")):
+		return "ape"
+	case bytes.HasPrefix(head, []byte("wvpk")):
+		return "wv"
+	case bytes.HasPrefix(head, []byte("MPCK")),
+	     bytes.HasPrefix(head, []byte("MP+")):
+		return "mpc"
+	case bytes.HasPrefix(head, []byte{0x1a, 0x45, 0xdf, 0xa3}):
+		return "mka"
+	case head[0] == 0xff && head[1] & 0xf6 == 0xf0:
+		/* ADTS */
+		return "aac"
+	}
+	return ""
+}
+
+func isAudio(name string) bool {
+	t := extType(name)
+	if AudioTypes[t] {
+		return true
+	} else if notAudio[t] {
+		return false
+	}
+	return AudioTypes[sniffType(name)]
+}
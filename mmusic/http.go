@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+/* A JSON API over HTTP, with -http.
+ *
+ *     GET  /status          what's playing and the modes
+ *     GET  /queue           upcoming
+ *     GET  /library         every song in the library
+ *     GET  /history         songs played, oldest first
+ *     POST /command/NAME    runs a command, arguments as {"args": [...]}
+ *                           in a JSON body
+ *     GET  /events          server-sent events as things change
+ *
+ * There's no login so it only listens on loopback, and any web page can
+ * send requests there so those from other origins are turned away.
+ * save isn't available at all as it writes to any file it is given.
+ */
+
+/* Commands that write files. */
+var httpDenied = map[string]bool{
+	"save": true,
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+/* Without a port, and without the brackets around an IPv6 address. */
+func hostName(host string) string {
+	h, _, err := net.SplitHostPort(host)
+	if err != nil {
+		h = host
+	}
+	return strings.Trim(h, "[]")
+}
+
+/* Requests must be for a loopback name, so a page on a name that has
+ * been pointed at 127.0.0.1 can't reach us, and if they come from a
+ * page it must be one of ours. */
+func checkOrigin(w http.ResponseWriter, r *http.Request) bool {
+	if !isLoopback(hostName(r.Host)) {
+		writeJSON(w, http.StatusForbidden,
+		          socketReply{Status: "error", Error: "bad host"})
+		return false
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != r.Host {
+			writeJSON(w, http.StatusForbidden,
+			          socketReply{Status: "error", Error: "cross-origin request"})
+			return false
+		}
+	}
+	return true
+}
+
+type jsonSong struct {
+	Path string `json:"path"`
+	Title string `json:"title,omitempty"`
+	/* Seconds, if known. */
+	Duration float64 `json:"duration,omitempty"`
+	Tags Tags `json:"tags,omitempty"`
+}
+
+type jsonStatus struct {
+	/* "play", "pause" or "stop". */
+	State string `json:"state"`
+	Current *jsonSong `json:"current"`
+	Position float64 `json:"position"`
+	Duration float64 `json:"duration"`
+	Volume int `json:"volume"`
+	Muted bool `json:"muted"`
+	Random bool `json:"random"`
+	/* "all", "one" or "once". */
+	Repeat string `json:"repeat"`
+	StopAfter bool `json:"stopafter"`
+	Crossfade int `json:"crossfade"`
+	Size int64 `json:"size"`
+}
+
+func (p *Player) jsonSong(s *Song) *jsonSong {
+	j := &jsonSong{
+		Path: s.Value,
+		Title: s.Title,
+		Duration: s.Duration.Seconds(),
+		Tags: p.index[s.Value],
+	}
+
+	if s == p.current && len(p.metadata) > 0 {
+		tags := Tags{}
+		for k, v := range j.Tags {
+			tags[k] = v
+		}
+		for k, v := range p.metadata {
+			tags[k] = v
+		}
+		j.Tags = tags
+	}
+	return j
+}
+
+func (p *Player) jsonSongs(songs []*Song) []*jsonSong {
+	list := make([]*jsonSong, len(songs))
+	for i, s := range songs {
+		list[i] = p.jsonSong(s)
+	}
+	return list
+}
+
+func (p *Player) jsonStatus() *jsonStatus {
+	status := &jsonStatus{
+		State: "play",
+		Volume: p.volume,
+		Muted: p.muted,
+		Random: p.random,
+		Repeat: "all",
+		StopAfter: p.stopAfter,
+		Crossfade: p.crossfade,
+		Size: p.size,
+	}
+
+	if p.stopped {
+		status.State = "stop"
+	} else if p.paused {
+		status.State = "pause"
+	}
+
+	switch p.repeat {
+	case RepeatOne:
+		status.Repeat = "one"
+	case RepeatOnce:
+		status.Repeat = "once"
+	}
+
+	if p.current != nil && !p.stopped {
+		status.Current = p.jsonSong(p.current)
+		position, duration := p.Position()
+		status.Position = position.Seconds()
+		status.Duration = duration.Seconds()
+	}
+	return status
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+/* Handles GET for a path, get is run from Run. */
+func (p *Player) handleGet(pattern string, get func() interface{}) {
+	http.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if !checkOrigin(w, r) {
+			return
+		}
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			writeJSON(w, http.StatusMethodNotAllowed,
+			          socketReply{Status: "error", Error: "only GET"})
+			return
+		}
+
+		var v interface{}
+		p.Call(func() {
+			v = get()
+		})
+		writeJSON(w, http.StatusOK, v)
+	})
+}
+
+func (p *Player) handleCommand(w http.ResponseWriter, r *http.Request) {
+	if !checkOrigin(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeJSON(w, http.StatusMethodNotAllowed,
+		          socketReply{Status: "error", Error: "only POST"})
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/command/")
+	if httpDenied[name] {
+		writeJSON(w, http.StatusForbidden, socketReply{Status: "error",
+		          Error: fmt.Sprintf("%s isn't available over http", name)})
+		return
+	}
+
+	/* Browsers won't send JSON to another origin without asking first,
+	 * unlike forms. */
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		writeJSON(w, http.StatusUnsupportedMediaType,
+		          socketReply{Status: "error", Error: "body must be JSON"})
+		return
+	}
+
+	var body struct {
+		Args []string `json:"args"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest,
+		          socketReply{Status: "error", Error: err.Error()})
+		return
+	}
+	args := body.Args
+
+	if name == "exit" {
+		/* There won't be anyone left to reply after. */
+		writeJSON(w, http.StatusOK, socketReply{Status: "ok"})
+		w.(http.Flusher).Flush()
+	}
+
+	p.Call(func() {
+		err = doFunction(p, append([]string{name}, args...))
+	})
+
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest,
+		          socketReply{Status: "error", Error: err.Error()})
+	} else {
+		writeJSON(w, http.StatusOK, socketReply{Status: "ok"})
+	}
+}
+
+/* Each event is sent with the status as it is after it, named as in
+ * events.go. */
+func (p *Player) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if !checkOrigin(w, r) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var events chan string
+	var status []byte
+	p.Call(func() {
+		events = p.Subscribe()
+		status, _ = json.Marshal(p.jsonStatus())
+	})
+	defer p.Call(func() {
+		p.Unsubscribe(events)
+	})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprintf(w, "event: status\ndata: %s\n\n", status)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event := <-events:
+			p.Call(func() {
+				status, _ = json.Marshal(p.jsonStatus())
+			})
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, status)
+		case <-keepAlive.C:
+			fmt.Fprintf(w, ": keep alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (p *Player) ListenHTTP(addr string) error {
+	if !strings.Contains(addr, "/") {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		} else if !isLoopback(host) {
+			return fmt.Errorf("%s isn't a loopback address, use localhost or a socket path", addr)
+		}
+	}
+
+	p.handleGet("/status", func() interface{} {
+		return p.jsonStatus()
+	})
+	p.handleGet("/queue", func() interface{} {
+		return p.jsonSongs(p.upcomingSongs())
+	})
+	p.handleGet("/library", func() interface{} {
+		var songs []*Song
+		for s := p.songs.Next; s != nil; s = s.Next {
+			songs = append(songs, s)
+		}
+		return p.jsonSongs(songs)
+	})
+	p.handleGet("/history", func() interface{} {
+		return p.jsonSongs(p.history)
+	})
+	http.HandleFunc("/command/", p.handleCommand)
+	http.HandleFunc("/events", p.handleEvents)
+
+	listener, err := netListen(addr)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(addr, "/") {
+		err = os.Chmod(addr, 0600)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
+	go func() {
+		err := http.Serve(listener, nil)
+		log.Println("http:", err)
+	}()
+	return nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+)
+
+/* The songs from a set of playlist files. */
+type Library struct {
+	songs *Song
+	size int64
+	summary *ScanSummary
+	exclusions []*Exclusion
+	/* To be added to the library rather than replacing it. */
+	merge bool
+	err error
+}
+
+/* Scans the playlist files in names, followed by the files and
+ * directories in paths, into a new library. */
+func loadLibrary(names []string, paths []string) *Library {
+	lib := &Library{songs: new(Song), summary: new(ScanSummary)}
+	t := lib.songs
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			lib.err = err
+			return lib
+		}
+
+		var e []*Exclusion
+		t.Next, e = scan(f, lib.summary)
+		lib.exclusions = append(lib.exclusions, e...)
+		for ; t.Next != nil; t = t.Next {}
+
+		f.Close()
+	}
+
+	if len(paths) > 0 {
+		added := new(Song)
+		s := added
+		for _, value := range paths {
+			s.Next = &Song{Value: value}
+			s = s.Next
+		}
+		fillSubDirs(added, lib.summary)
+
+		/* Like when they were added, only what isn't there already. */
+		have := make(map[string]bool)
+		for s := lib.songs.Next; s != nil; s = s.Next {
+			have[s.Value] = true
+		}
+		for s := added.Next; s != nil; s = s.Next {
+			if !have[s.Value] {
+				t.Next = s
+				t = s
+				have[s.Value] = true
+			}
+		}
+		t.Next = nil
+	}
+
+	lib.summary.Excluded = exclude(lib.songs, lib.exclusions)
+	for s := lib.songs.Next; s != nil; s = s.Next {
+		lib.size++
+	}
+
+	if libraryCache != nil {
+		err := libraryCache.Save()
+		if err != nil {
+			log.Println("saving library cache:", err)
+		}
+	}
+
+	return lib
+}
+
+func (p *Player) writePlaylist() {
+	var lines []string
+	for s := p.songs.Next; s != nil; s = s.Next {
+		lines = append(lines, s.Value)
+	}
+	writeLinesToValue(p.tmpDir + SuffixPlaylist, lines)
+}
+
+/* Finds s in songs, or makes a copy of it that isn't part of the library
+ * so moving on from it doesn't lead back in to an old one. */
+func relink(songs map[string]*Song, s *Song) *Song {
+	if s == nil {
+		return nil
+	} else if t := songs[s.Value]; t != nil {
+		return t
+	}
+	return &Song{Value: s.Value, Title: s.Title, Duration: s.Duration}
+}
+
+/* Switches to lib, whatever is playing carries on. */
+func (p *Player) setLibrary(lib *Library) {
+	p.songs = lib.songs
+	p.size = lib.size
+	p.exclusions = lib.exclusions
+
+	songs := make(map[string]*Song)
+	for s := p.songs.Next; s != nil; s = s.Next {
+		if songs[s.Value] == nil {
+			songs[s.Value] = s
+		}
+	}
+	p.current = relink(songs, p.current)
+	p.queued = relink(songs, p.queued)
+	for i, s := range p.history {
+		p.history[i] = relink(songs, s)
+	}
+	for i, s := range p.future {
+		p.future[i] = relink(songs, s)
+	}
+	p.shuffle = nil
+	p.shufflePos = 0
+
+	p.writePlaylist()
+	log.Printf("found %d songs, excluded %d, skipped %d other files",
+	           p.size, lib.summary.Excluded, len(lib.summary.Rejected))
+	writeLinesToValue(p.tmpDir + SuffixRejected, lib.summary.Rejected)
+
+	if p.indexing {
+		p.IndexLibrary()
+	}
+	p.watchDirs(lib.summary.Dirs)
+	p.notify(EventDatabase)
+}
+
+/* Adds the songs in lib to the end of the library, leaving out any
+ * already in it. Random mode carries on with the same order with the new
+ * songs shuffled in to what is left of it. */
+func (p *Player) mergeLibrary(lib *Library) {
+	excluded := lib.summary.Excluded
+	if len(lib.exclusions) > 0 {
+		excluded += p.removeMatching(func(s *Song) bool {
+			for _, e := range lib.exclusions {
+				if e.Match(s.Value) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+
+	t := p.songs
+	have := make(map[string]bool)
+	for ; t.Next != nil; t = t.Next {
+		have[t.Next.Value] = true
+	}
+
+	added := 0
+	for s := lib.songs.Next; s != nil; {
+		next := s.Next
+		if have[s.Value] {
+			s = next
+			continue
+		}
+
+		s.Next = nil
+		for _, e := range p.exclusions {
+			if e.Match(s.Value) {
+				s = nil
+				excluded++
+				break
+			}
+		}
+		if s != nil {
+			t.Next = s
+			t = s
+			have[s.Value] = true
+			p.shuffleIn(s)
+			added++
+		}
+		s = next
+	}
+
+	p.size += int64(added)
+	p.exclusions = append(p.exclusions, lib.exclusions...)
+
+	p.writePlaylist()
+	log.Printf("added %d songs, excluded %d, skipped %d other files",
+	           added, excluded, len(lib.summary.Rejected))
+
+	if p.indexing {
+		p.IndexLibrary()
+	}
+	p.addWatches(lib.summary.Dirs)
+	p.notify(EventDatabase)
+}
+
+/* Runs load in the background, Run switches to or adds what it finds
+ * once it is done. */
+func (p *Player) loadInBackground(load func() *Library) error {
+	if p.reloading {
+		return errors.New("busy loading the library")
+	}
+
+	p.reloading = true
+	go func() {
+		p.reloaded <- load()
+	}()
+	return nil
+}
+
+/* Scans the playlist files again, along with anything added. */
+func (p *Player) Reload() error {
+	names, paths := p.playlists, p.added
+	return p.loadInBackground(func() *Library {
+		return loadLibrary(names, paths)
+	})
+}
+
+/* Replaces the library with the songs from the playlist file name. */
+func (p *Player) Load(name string) error {
+	_, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	err = p.loadInBackground(func() *Library {
+		return loadLibrary([]string{name}, nil)
+	})
+	if err == nil {
+		p.playlists = []string{name}
+		p.added = nil
+	}
+	return err
+}
+
+/* Adds the songs from the playlist file name to the library. */
+func (p *Player) Append(name string) error {
+	_, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	err = p.loadInBackground(func() *Library {
+		lib := loadLibrary([]string{name}, nil)
+		lib.merge = true
+		return lib
+	})
+	if err == nil {
+		p.playlists = append(p.playlists, name)
+	}
+	return err
+}
+
+/* Adds a file, directory or uri to the library. */
+func (p *Player) Add(value string) error {
+	if !strings.Contains(value, "://") {
+		_, err := os.Stat(value)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := p.loadInBackground(func() *Library {
+		lib := loadLibrary(nil, []string{value})
+		lib.merge = true
+		return lib
+	})
+	if err == nil {
+		p.added = append(p.added, value)
+	}
+	return err
+}
+
+func (p *Player) finishReload(lib *Library) {
+	p.reloading = false
+	if lib.err != nil {
+		log.Println("reload:", lib.err)
+	} else if lib.merge {
+		p.mergeLibrary(lib)
+	} else {
+		p.setLibrary(lib)
+	}
+}
+
+/* Puts s somewhere in what's left of this round of random mode. */
+func (p *Player) shuffleIn(s *Song) {
+	if p.shuffle == nil {
+		return
+	}
+
+	i := p.shufflePos + rand.Intn(len(p.shuffle) - p.shufflePos + 1)
+	p.shuffle = append(p.shuffle, nil)
+	copy(p.shuffle[i+1:], p.shuffle[i:])
+	p.shuffle[i] = s
+}
+
+/* Removes songs from the library that match, returning how many were.
+ * Removed songs keep their Next so if one is playing it carries on to
+ * what followed it. */
+func (p *Player) removeMatching(match func(*Song) bool) int {
+	removed := 0
+	prev := p.songs
+	for s := p.songs.Next; s != nil; s = s.Next {
+		if match(s) {
+			prev.Next = s.Next
+			delete(p.index, s.Value)
+			log.Println("removed", s.Value)
+			removed++
+		} else {
+			prev = s
+		}
+	}
+	p.size -= int64(removed)
+
+	if p.shuffle != nil {
+		shuffle := p.shuffle[:0]
+		pos := p.shufflePos
+		for i, s := range p.shuffle {
+			if !match(s) {
+				shuffle = append(shuffle, s)
+			} else if i < p.shufflePos {
+				pos--
+			}
+		}
+		p.shuffle = shuffle
+		p.shufflePos = pos
+	}
+
+	return removed
+}
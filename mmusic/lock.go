@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+/* The lock is held for as long as mmusic runs, the kernel lets go of it
+ * however we exit so a tmp dir with an unlocked lock file was left by
+ * something that's gone. */
+
+/* Takes the lock in the tmp dir, which must exist. Returns the pid of
+ * the instance holding it if it can't be taken. */
+func (p *Player) lockTmp() (int, error) {
+	f, err := os.OpenFile(p.tmpDir + SuffixLock, os.O_RDWR | os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX | syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		f.Close()
+		data, _ := ioutil.ReadFile(p.tmpDir + SuffixPid)
+		pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+		return pid, err
+	} else if err != nil {
+		f.Close()
+		return 0, err
+	}
+
+	p.lockFile = f
+	writeStringToValue(p.tmpDir + SuffixPid, strconv.Itoa(os.Getpid()) + "\n")
+	return 0, nil
+}
+
+/* Removes everything left in the tmp dir by an instance that died,
+ * except the lock which we now hold and our pid. */
+func (p *Player) cleanTmp() {
+	names, err := ioutil.ReadDir(p.tmpDir)
+	if err != nil {
+		return
+	}
+	for _, fi := range names {
+		name := "/" + fi.Name()
+		if name != SuffixLock && name != SuffixPid {
+			os.RemoveAll(p.tmpDir + name)
+		}
+	}
+}
+
+/* Makes the tmp dir or takes over one left behind, exiting if another
+ * instance is using it. */
+func (p *Player) claimTmp() {
+	err := os.Mkdir(p.tmpDir, 0700)
+	stale := os.IsExist(err)
+	if err != nil && !stale {
+		fmt.Println("tmp dir:", err)
+		os.Exit(1)
+	}
+
+	pid, err := p.lockTmp()
+	if err == syscall.EWOULDBLOCK {
+		if pid != 0 {
+			fmt.Printf("mmusic is already running (pid %d) with tmp dir %s\n",
+			           pid, p.tmpDir)
+		} else {
+			fmt.Println("mmusic is already running with tmp dir", p.tmpDir)
+		}
+		os.Exit(1)
+	} else if err != nil {
+		fmt.Println("tmp dir:", err)
+		os.Exit(1)
+	}
+
+	if stale {
+		fmt.Println("tmp dir:", p.tmpDir, "left by an instance that is gone, reusing it.")
+		p.cleanTmp()
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"os"
 	"io"
+	"log"
+	"bufio"
+	"strconv"
 	"os/signal"
 	"syscall"
 	"flag"
@@ -11,6 +14,7 @@ import (
 	"time"
 	"math/rand"
 	"sort"
+	"path"
 	"github.com/ziutek/gst"
 )
 
@@ -20,26 +24,178 @@ var SuffixUpcoming string   = "/upcoming"
 var SuffixPlaying string    = "/playing"
 var SuffixIsRandom string   = "/israndom"
 var SuffixIsPaused string   = "/ispaused"
+var SuffixVolume string     = "/volume"
+var SuffixIsMuted string    = "/ismuted"
+var SuffixPosition string   = "/position"
+var SuffixHistory string    = "/history"
+var SuffixCrossfade string  = "/crossfade"
+var SuffixIsRepeatOne string = "/isrepeatone"
+var SuffixIsOnce string     = "/isonce"
+var SuffixIsStopAfter string = "/isstopafter"
+var SuffixIsStopped string  = "/isstopped"
+var SuffixErrors string     = "/errors"
+var SuffixFailed string     = "/failed"
+var SuffixMetadata string   = "/metadata"
+var SuffixIndex string      = "/index"
+var SuffixRejected string   = "/rejected"
+var SuffixSocket string     = "/socket"
+var SuffixLock string       = "/lock"
+var SuffixPid string        = "/pid"
+
+const (
+	RepeatAll = iota
+	RepeatOne
+	RepeatOnce
+)
+
+var VolumeStep int = 5
+var HistorySize int = 100
+var ErrorsSize int = 100
+
+/* Songs that fail this many times are not picked again. */
+var MaxFailures int = 3
+/* After this many errors in a row wait before trying the next song,
+ * doubling the wait each time up to MaxBackoff. */
+var BackoffAfter int = 3
+var MaxBackoff time.Duration = time.Minute
+var FadeStep time.Duration = 100 * time.Millisecond
+
+/* GST_CLOCK_TIME_NONE */
+var BusWaitForever uint64 = ^uint64(0)
 
 type Song struct {
 	Value string
+	/* From extended playlists, if they give them. */
+	Title string
+	Duration time.Duration
 	Next *Song
 }
 
+/* Keys are those in TagNames. */
+type Tags map[string]string
+
+var TagNames = []string{
+	"title", "artist", "album", "track", "genre", "bitrate", "codec",
+}
+
+/* key=value lines in the order of TagNames. */
+func (t Tags) String() string {
+	var str string
+	for _, name := range TagNames {
+		value, ok := t[name]
+		if ok {
+			str += name + "=" + strings.Replace(value, "\n", " ", -1) + "\n"
+		}
+	}
+	return str
+}
+
+type busMessage struct {
+	snd *gst.Element
+	mesg *gst.Message
+}
+
+type finishRequest struct {
+	snd *gst.Element
+	reply chan string
+}
+
 type Player struct {
+	/* snd is what is playing, spare is used to crossfade in to the next
+	 * song and is swapped with snd when a fade starts. */
 	snd *gst.Element
-	bus *gst.Bus
+	spare *gst.Element
+	fading *gst.Element
+	fadeStart time.Time
+	fadeTicker *time.Ticker
+	fadeTick <-chan time.Time
+	
+	crossfade int
 	
 	size int64 
 	songs *Song
 	
 	current *Song
+	metadata Tags
+	queued *Song
+	/* queued is the current song again, for repeat one, or came from
+	 * upcoming. */
+	queuedRepeat bool
+	queuedUpcoming bool
+	/* A song playbin has been given that is no longer wanted, see
+	 * unqueue. */
+	unqueued *Song
+	history []*Song
+	future []*Song
+	
+	shuffle []*Song
+	shufflePos int
+	
+	errors []string
+	failures map[string]int
+	failed map[string]bool
+	errorsInRow int
+	retry <-chan time.Time
 
 	random bool
+	paused bool
+	
+	/* RepeatAll, RepeatOne or RepeatOnce */
+	repeat int
+	stopAfter bool
+	stopped bool
+	/* Whether the current song played to the end before stopping. */
+	finished bool
+	
+	volume int
+	muted bool
 	
 	playingFile *os.File
 	
+	finishing chan *finishRequest
+	
+	index map[string]Tags
+	indexGen int
+	indexed chan *indexResult
+	indexing bool
+	
+	/* The playlist files given, reread by reload. */
+	playlists []string
+	/* Files and directories added with add, kept when reloading. */
+	added []string
+	reloading bool
+	reloaded chan *Library
+	exclusions []*Exclusion
+	
+	watcher *Watcher
+	watchEvents chan WatchEvent
+	
+	/* Functions run from Run for other goroutines, see Call. */
+	calls chan func()
+	subscribers map[chan string]bool
+	upcomingStamp int64
+	
+	mpd *mpdQueue
+	started time.Time
+	/* Counts seeks, for MPRIS's Seeked signal. */
+	seeks int
+	
+	/* A song restored from the saved state, to be seeked to resumeAt
+	 * once it has prerolled. */
+	resume *Song
+	resumeAt time.Duration
+	/* Where the state is saved on exit, empty to not. */
+	statePath string
+	
+	/* Where reload-config reads from, and the flags it leaves alone. */
+	configPath string
+	explicit map[string]bool
+	logFile *os.File
+	sinkProps []sinkProperty
+	
 	tmpDir string
+	/* Held open for its lock, see lock.go. */
+	lockFile *os.File
 }
 
 func PopLine(file *os.File) (string, error) {
@@ -73,57 +229,80 @@ func PopLine(file *os.File) (string, error) {
 	return line, nil
 }
 
-func fillSubDirs(songs *Song) {
+func fillSubDirs(songs *Song, summary *ScanSummary) {
 	var prev, next, t, s *Song
+	/* Whether things found in directories are directories themselves,
+	 * saves a stat for each. */
+	isDir := make(map[string]bool)
+	
 	prev = songs
 	for s = songs.Next; s != nil; s = s.Next {
-		fi, err := os.Stat(s.Value)
-		if err != nil || !fi.IsDir() {
+		dir, known := isDir[s.Value]
+		if !known {
+			fi, err := os.Stat(s.Value)
+			dir = err == nil && fi.IsDir()
+		}
+		
+		if !dir {
 			prev = s
 			continue
 		}
 			
-		file, err := os.Open(s.Value)
+		entries, err := readDir(s.Value)
 		if err != nil {
 			prev = s
-			file.Close()
 			continue
 		}
-			
-		subs, err := file.Readdirnames(0)
-		if err != nil {
-			panic(err)
-		}
-			
-		sort.Strings(subs)
+		summary.Dirs = append(summary.Dirs, s.Value)
 			
 		next = s.Next
 		t = s
-		for _, sub := range subs {
+		for _, entry := range entries {
+			value := s.Value + "/" + entry.Name
+			if !entry.IsDir && !isAudio(value) {
+				summary.Rejected = append(summary.Rejected, value)
+				continue
+			}
+			
 			t.Next = new(Song)
 			t = t.Next
-			t.Value = s.Value + "/" + sub
+			t.Value = value
+			isDir[t.Value] = entry.IsDir
 		}
 		
 		t.Next = next
 			
 		prev.Next = s.Next
-		file.Close()
 	}
 }
 
-func scan(file *os.File) (songs *Song) {
+/* Returns the songs in the playlist file along with any exclusions in
+ * it, which are left to be applied once every file has been scanned. */
+func scan(file *os.File, summary *ScanSummary) (songs *Song, exclusions []*Exclusion) {
 	var s *Song
 	
 	songs = new(Song)
 	s = songs
 	
-	for {
+	format := playlistFormat(file)
+	if format != FormatPlain {
+		songs.Next, exclusions = readPlaylist(file, format)
+	}
+	
+	for format == FormatPlain {
 		line, err := PopLine(file)
 		if err != nil {
 			break
 		} else if line == "" {
 			continue
+		} else if line[0] == '!' {
+			e, err := ParseExclusion(line[1:])
+			if err != nil {
+				log.Println(file.Name() + ":", err)
+			} else {
+				exclusions = append(exclusions, e)
+			}
+			continue
 		}
 
 		s.Next = new(Song)
@@ -131,9 +310,9 @@ func scan(file *os.File) (songs *Song) {
 		s.Value = line
 	}
 	
-	fillSubDirs(songs)
+	fillSubDirs(songs, summary)
 	
-	return songs.Next
+	return songs.Next, exclusions
 }
 
 func writeStringToValue(path string, s string) {
@@ -144,38 +323,246 @@ func writeStringToValue(path string, s string) {
 	}
 }
 
+func writeLinesToValue(path string, lines []string) {
+	if len(lines) == 0 {
+		writeStringToValue(path, "")
+	} else {
+		writeStringToValue(path, strings.Join(lines, "\n") + "\n")
+	}
+}
+
 func (p *Player) Exit() {
+	if p.statePath != "" {
+		err := p.SaveState(p.statePath)
+		if err != nil {
+			log.Println("saving state:", err)
+		}
+	}
 	os.RemoveAll(p.tmpDir)
 	os.Exit(0)
 }
 
 func (p *Player) SetModeRandom() {
+	if !p.random && p.queued != nil {
+		p.unqueue()
+	}
 	p.random = true
 	f, err := os.Create(p.tmpDir + SuffixIsRandom)
 	if err == nil {
 		f.Close()
 	}
+	p.notify(EventOptions)
 }
 
 func (p *Player) SetModeNormal() {
+	if p.random && p.queued != nil {
+		p.unqueue()
+	}
 	p.random = false
 	os.Remove(p.tmpDir + SuffixIsRandom)
+	p.notify(EventOptions)
+}
+
+func createValue(path string, exists bool) {
+	if exists {
+		f, err := os.Create(path)
+		if err == nil {
+			f.Close()
+		}
+	} else {
+		os.Remove(path)
+	}
+}
+
+func (p *Player) SetRepeat(mode int) {
+	if mode != p.repeat && p.queued != nil {
+		p.unqueue()
+	}
+	p.repeat = mode
+	createValue(p.tmpDir + SuffixIsRepeatOne, mode == RepeatOne)
+	createValue(p.tmpDir + SuffixIsOnce, mode == RepeatOnce)
+	p.notify(EventOptions)
+}
+
+func (p *Player) SetStopAfter(stop bool) {
+	p.stopAfter = stop
+	createValue(p.tmpDir + SuffixIsStopAfter, stop)
+	p.notify(EventOptions)
+}
+
+/* Stops playback but keeps running. If the current song played to the
+ * end play carries on with whatever comes after it, otherwise the song
+ * is started again. */
+func (p *Player) Stop(finished bool) {
+	p.StopFade()
+	p.dropQueued(nil)
+	p.unqueued = nil
+	p.snd.SetState(gst.STATE_NULL)
+	p.stopped = true
+	p.finished = finished
+	p.paused = false
+	
+	os.Remove(p.tmpDir + SuffixIsPaused)
+	createValue(p.tmpDir + SuffixIsStopped, true)
+	writeStringToValue(p.tmpDir + SuffixPlaying, "")
+	writeStringToValue(p.tmpDir + SuffixPosition, "0 0\n")
+	p.notify(EventPlayer)
+}
+
+func (p *Player) Start() {
+	if !p.stopped {
+		p.Resume()
+	} else if p.current != nil && !p.finished {
+		p.Play(p.current)
+	} else {
+		p.PlayNext()
+	}
 }
 
 func (p *Player) Pause() {
+	if p.stopped {
+		return
+	}
+	
+	p.StopFade()
+	p.paused = true
 	p.snd.SetState(gst.STATE_PAUSED)
 	f, err := os.Create(p.tmpDir + SuffixIsPaused)
 	if err == nil {
 		f.Close()
 	}
+	p.notify(EventPlayer)
 }
 
 func (p *Player) Resume() {
+	if p.stopped {
+		p.Start()
+		return
+	}
+	
+	p.paused = false
 	p.snd.SetState(gst.STATE_PLAYING)
 	os.Remove(p.tmpDir + SuffixIsPaused)
+	p.notify(EventPlayer)
+}
+
+func (p *Player) applyVolume() {
+	p.snd.SetProperty("volume", float64(p.volume) / 100)
+	p.snd.SetProperty("mute", p.muted)
+	if p.fading != nil {
+		p.fading.SetProperty("mute", p.muted)
+	}
+}
+
+func (p *Player) SetVolume(volume int) {
+	if volume < 0 {
+		volume = 0
+	} else if volume > 100 {
+		volume = 100
+	}
+	
+	p.volume = volume
+	p.applyVolume()
+	writeStringToValue(p.tmpDir + SuffixVolume,
+	                   strconv.Itoa(p.volume) + "\n")
+	p.notify(EventMixer)
+}
+
+func (p *Player) Mute() {
+	p.muted = true
+	p.applyVolume()
+	f, err := os.Create(p.tmpDir + SuffixIsMuted)
+	if err == nil {
+		f.Close()
+	}
+	p.notify(EventMixer)
+}
+
+func (p *Player) Unmute() {
+	p.muted = false
+	p.applyVolume()
+	os.Remove(p.tmpDir + SuffixIsMuted)
+	p.notify(EventMixer)
 }
 
-func (p *Player) PopUpcoming() error {
+func (p *Player) Position() (position, duration time.Duration) {
+	pos, ok := p.snd.QueryPosition(gst.FORMAT_TIME)
+	if ok {
+		position = time.Duration(pos)
+	}
+	
+	dur, ok := p.snd.QueryDuration(gst.FORMAT_TIME)
+	if ok {
+		duration = time.Duration(dur)
+	}
+	
+	return position, duration
+}
+
+func (p *Player) UpdatePosition() {
+	position, duration := p.Position()
+	writeStringToValue(p.tmpDir + SuffixPosition,
+	                   fmt.Sprintf("%d %d\n", int64(position.Seconds()),
+	                               int64(duration.Seconds())))
+}
+
+func (p *Player) Seek(position time.Duration) {
+	_, duration := p.Position()
+	if position < 0 {
+		position = 0
+	} else if duration > 0 && position > duration {
+		position = duration
+	}
+	
+	p.snd.SeekSimple(gst.FORMAT_TIME,
+	                 gst.SEEK_FLAG_FLUSH | gst.SEEK_FLAG_KEY_UNIT,
+	                 int64(position))
+	p.UpdatePosition()
+	p.seeks++
+	p.notify(EventPlayer)
+}
+
+/* Parses "[h:]m:ss" or plain seconds. */
+func parseTime(str string) (time.Duration, error) {
+	var t int64
+	for _, part := range strings.Split(str, ":") {
+		n, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid time %q", str)
+		}
+		t = t * 60 + int64(n)
+	}
+	
+	return time.Duration(t) * time.Second, nil
+}
+
+/* "+N" and "-N" seek relative to the current position, anything else
+ * is an absolute time. */
+func (p *Player) SeekTo(arg string) error {
+	if strings.HasPrefix(arg, "+") || strings.HasPrefix(arg, "-") {
+		offset, err := parseTime(arg[1:])
+		if err != nil {
+			return err
+		}
+		if arg[0] == '-' {
+			offset = -offset
+		}
+		
+		position, _ := p.Position()
+		p.Seek(position + offset)
+	} else {
+		position, err := parseTime(arg)
+		if err != nil {
+			return err
+		}
+		
+		p.Seek(position)
+	}
+	
+	return nil
+}
+
+func (p *Player) PopUpcoming() (*Song, error) {
 	var s *Song
 	var data []byte = make([]byte, 2048)
 	var top string
@@ -187,11 +574,11 @@ func (p *Player) PopUpcoming() error {
 	
 	top, err = PopLine(upcomingFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	
 	if top == "" {
-		return io.EOF
+		return nil, io.EOF
 	}
 	
 	tmpFile, err := os.Create(p.tmpDir + "/.tmp")
@@ -226,42 +613,156 @@ func (p *Player) PopUpcoming() error {
 		s.Value = top
 	}
 	
-	p.current = s
-	return nil
+	return s, nil
 }
 
-/* TODO: improve this so it's not so random.
- * http://keyj.emphy.de/balanced-shuffle/
- */
-func (p *Player) PickRandom() {
-	n := int(rand.Int63n(p.size))
-	p.current = p.songs.Next
-	for i := 0; i < n && p.current != nil; i++ {
-		p.current = p.current.Next
+type shuffleSlot struct {
+	position float64
+	song *Song
+}
+
+/* Balanced shuffle, http://keyj.emphy.de/balanced-shuffle/
+ * Songs are grouped by directory and each group is spread evenly over
+ * the order (with a random offset and a little jitter) so songs from
+ * the same place don't bunch up. */
+func balancedShuffle(songs *Song) []*Song {
+	groups := make(map[string][]*Song)
+	for s := songs.Next; s != nil; s = s.Next {
+		dir := path.Dir(s.Value)
+		groups[dir] = append(groups[dir], s)
+	}
+	
+	var slots []shuffleSlot
+	for _, group := range groups {
+		n := float64(len(group))
+		offset := rand.Float64() / n
+		for i, j := range rand.Perm(len(group)) {
+			jitter := (rand.Float64() - 0.5) * 0.2 / n
+			slots = append(slots, shuffleSlot{
+				offset + float64(i) / n + jitter, group[j]})
+		}
+	}
+	
+	sort.Slice(slots, func(i, j int) bool {
+		return slots[i].position < slots[j].position
+	})
+	
+	order := make([]*Song, len(slots))
+	for i, slot := range slots {
+		order[i] = slot.song
 	}
+	return order
 }
 
-func (p *Player) PickNormal() {
-	if p.current != nil {
-		p.current = p.current.Next
+func (p *Player) Reshuffle() {
+	p.shuffle = balancedShuffle(p.songs)
+	p.shufflePos = 0
+	
+	/* Don't play the last song of one round first in the next. */
+	n := len(p.shuffle)
+	if n > 1 && p.shuffle[0] == p.current {
+		i := 1 + rand.Intn(n - 1)
+		p.shuffle[0], p.shuffle[i] = p.shuffle[i], p.shuffle[0]
 	}
+}
 
-	if p.current == nil {
-		p.current = p.songs.Next
+/* Walks through the shuffled order so nothing repeats until everything
+ * has been played. */
+func (p *Player) PickRandom() *Song {
+	reshuffled := false
+	for {
+		if p.shufflePos >= len(p.shuffle) {
+			/* An empty shuffle hasn't been made yet, rather than a
+			 * round having finished. */
+			if p.repeat == RepeatOnce && p.current != nil &&
+			   len(p.shuffle) > 0 {
+				return nil
+			} else if reshuffled {
+				/* Everything has failed. */
+				return nil
+			}
+			p.Reshuffle()
+			reshuffled = true
+		}
+		
+		s := p.shuffle[p.shufflePos]
+		p.shufflePos++
+		if !p.failed[s.Value] {
+			return s
+		}
+	}
+}
+
+/* Where normal mode carries on from. Usually the current song, but one
+ * from outside the library (from upcoming say) doesn't lead anywhere so
+ * it's the last song played that was in it, or nil for the start. */
+func (p *Player) normalFrom() *Song {
+	if p.current == nil || p.current.Next != nil {
+		return p.current
 	}
+	
+	library := make(map[*Song]bool)
+	for s := p.songs.Next; s != nil; s = s.Next {
+		library[s] = true
+	}
+	if library[p.current] {
+		return p.current
+	}
+	for i := len(p.history) - 1; i >= 0; i-- {
+		if library[p.history[i]] {
+			return p.history[i]
+		}
+	}
+	return nil
 }
 
-func (p *Player) PickNext() {
-	err := p.PopUpcoming()
+func (p *Player) PickNormal() *Song {
+	from := p.normalFrom()
+	s := from
+	for i := int64(0); i <= p.size; i++ {
+		if s != nil {
+			s = s.Next
+		}
+		
+		if s == nil {
+			if p.repeat == RepeatOnce && from != nil {
+				return nil
+			}
+			s = p.songs.Next
+		}
+		
+		if !p.failed[s.Value] {
+			return s
+		}
+	}
+	return nil
+}
+
+/* Returns nil if there is nothing left to play. */
+func (p *Player) PickNext() *Song {
+	s, err := p.PopUpcoming()
 	if err == nil {
-		return
+		return s
+	} else if p.random && len(p.future) > 0 {
+		/* Going forward again after a prev. */
+		return p.future[len(p.future)-1]
 	} else if p.size == 0 {
-		p.Exit()
+		return nil
 	} else if p.random {
-		p.PickRandom()
-	} else {
-		p.PickNormal()
+		return p.PickRandom()
+	}
+	return p.PickNormal()
+}
+
+/* Like PickNext but for when the current song ends on its own rather
+ * than being skipped. */
+func (p *Player) PickFollowing() *Song {
+	if p.stopAfter {
+		return nil
+	} else if p.repeat == RepeatOne && p.current != nil {
+		return p.current
 	}
+	return p.PickNext()
 }
 
 func makeURI(str string) string {
@@ -276,131 +777,687 @@ func makeURI(str string) string {
 	}
 }
 
+func (p *Player) writeHistory() {
+	var data string
+	for _, s := range p.history {
+		data += s.Value + "\n"
+	}
+	writeStringToValue(p.tmpDir + SuffixHistory, data)
+}
+
+/* Moves the current song into the history before s is played. If s is
+ * where a prev left off we keep the rest of the way forward. */
+func (p *Player) pushHistory(s *Song) {
+	if len(p.future) > 0 && p.future[len(p.future)-1] == s {
+		p.future = p.future[:len(p.future)-1]
+	} else {
+		p.future = nil
+	}
+	
+	if p.current != nil {
+		p.history = append(p.history, p.current)
+		if len(p.history) > HistorySize {
+			p.history = p.history[len(p.history)-HistorySize:]
+		}
+	}
+	
+	p.writeHistory()
+}
+
 func (p *Player) PlayNext() {
-	p.PickNext()
-	uri := makeURI(p.current.Value)
+	/* Something may already have been picked for a gapless switch that
+	 * has not started yet, don't lose it. Unless it's the current song
+	 * repeating, next always moves on. */
+	s := p.queued
+	if s == nil || p.queuedRepeat {
+		s = p.PickNext()
+	}
+	
+	if s == nil {
+		p.End()
+		return
+	}
+	p.pushHistory(s)
+	p.Play(s)
+}
+
+/* The current song has finished. */
+func (p *Player) Advance() {
+	s := p.queued
+	if s == nil {
+		s = p.PickFollowing()
+	}
+	
+	if s == nil {
+		p.End()
+		return
+	}
+	p.pushHistory(s)
+	p.Play(s)
+}
+
+/* Nothing more to play. If we ran off the end of the library the next
+ * play starts it over. */
+func (p *Player) End() {
+	if p.stopAfter {
+		p.SetStopAfter(false)
+	} else if p.current != nil {
+		p.pushHistory(nil)
+		p.current = nil
+	}
+	p.Stop(true)
+}
+
+func (p *Player) PlayPrev() {
+	if len(p.history) == 0 {
+		p.Seek(0)
+		return
+	}
+	
+	s := p.history[len(p.history)-1]
+	p.history = p.history[:len(p.history)-1]
+	if p.current != nil {
+		p.future = append(p.future, p.current)
+	}
+	
+	p.writeHistory()
+	p.Play(s)
+}
+
+func (p *Player) setCurrent(s *Song) {
+	p.current = s
+	p.paused = false
+	p.metadata = make(Tags)
+	writeStringToValue(p.tmpDir + SuffixMetadata, "")
+	os.Remove(p.tmpDir + SuffixIsPaused)
+	writeStringToValue(p.tmpDir + SuffixPlaying, makeURI(s.Value) + "\n")
+	writeStringToValue(p.tmpDir + SuffixPosition, "0 0\n")
+	p.notify(EventPlayer)
+	p.notify(EventPlaylist)
+}
+
+func (p *Player) Play(s *Song) {
+	p.StopFade()
+	p.dropQueued(s)
+	p.unqueued = nil
+	p.retry = nil
+	p.stopped = false
+	os.Remove(p.tmpDir + SuffixIsStopped)
 	p.snd.SetState(gst.STATE_NULL)
-	p.snd.SetProperty("uri", uri)
+	p.snd.SetProperty("uri", makeURI(s.Value))
+	p.applyVolume()
 	p.snd.SetState(gst.STATE_PLAYING)
+	p.setCurrent(s)
+}
 
-	os.Remove(p.tmpDir + SuffixIsPaused)
-	writeStringToValue(p.tmpDir + SuffixPlaying, uri + "\n")
+/* Picks what comes next so playbin can move straight on to it when the
+ * current stream ends. */
+func (p *Player) QueueNext() string {
+	if p.stopAfter {
+		/* Leave it to the EOS. */
+		return ""
+	}
+	
+	p.queuedRepeat = p.repeat == RepeatOne && p.current != nil
+	p.queuedUpcoming = !p.queuedRepeat && len(p.readUpcoming()) > 0
+	p.queued = p.PickFollowing()
+	if p.queued == nil {
+		return ""
+	}
+	return makeURI(p.queued.Value)
 }
 
-func listenFifo(p *Player, c chan string) {
-	var data = make([]byte, 512)
+/* The modes changed after the queued song was picked. playbin will
+ * still switch to it, so StartQueued moves on from there to what the
+ * modes now say. A song taken from upcoming goes back on top of it and
+ * random mode gets its pick back. */
+func (p *Player) unqueue() {
+	p.giveBackQueued()
+	p.unqueued = p.queued
+	p.queued = nil
+}
 
+/* Puts the queued song back where it was picked from. */
+func (p *Player) giveBackQueued() {
+	if p.queuedUpcoming {
+		p.writeUpcoming(append([]string{p.queued.Value}, p.readUpcoming()...))
+	} else if !p.queuedRepeat && p.random && p.shufflePos > 0 &&
+	          p.shuffle[p.shufflePos-1] == p.queued {
+		p.shufflePos--
+	}
+}
+
+/* Forgets the queued song when something else is played instead, or
+ * playback stops, so it isn't lost if it was taken from upcoming. */
+func (p *Player) dropQueued(s *Song) {
+	if p.queued != nil && p.queued != s {
+		p.giveBackQueued()
+	}
+	p.queued = nil
+}
+
+/* The queued song has started playing. */
+func (p *Player) StartQueued() {
+	if p.unqueued != nil {
+		p.unqueued = nil
+		p.Advance()
+		return
+	} else if p.queued == nil {
+		return
+	}
+	
+	s := p.queued
+	p.queued = nil
+	p.pushHistory(s)
+	p.setCurrent(s)
+	
+	/* stopafter was given after the switch was set up. */
+	if p.stopAfter {
+		p.SetStopAfter(false)
+		p.Stop(false)
+	}
+}
+
+/* Called from a gstreamer thread when snd is nearly done with the
+ * current stream. The next uri has to be set before we return for the
+ * switch to be gapless, so ask Run for it. If Run is busy (changing
+ * state on playbin say) give up, we just get an EOS instead. */
+func (p *Player) aboutToFinish(snd *gst.Element) {
+	req := &finishRequest{snd, make(chan string, 1)}
+	select {
+	case p.finishing <- req:
+		uri := <- req.reply
+		if uri != "" {
+			snd.SetProperty("uri", uri)
+		}
+	case <- time.After(time.Second):
+	}
+}
+
+func (p *Player) SetCrossfade(secs int) {
+	if secs < 0 {
+		secs = 0
+	}
+	
+	p.crossfade = secs
+	writeStringToValue(p.tmpDir + SuffixCrossfade,
+	                   strconv.Itoa(p.crossfade) + "\n")
+	p.notify(EventOptions)
+}
+
+/* Starts the next song on the spare playbin and ramps the volumes of the
+ * two over the crossfade time. */
+func (p *Player) StartFade() {
+	s := p.PickFollowing()
+	if s == nil {
+		return
+	}
+	
+	p.fading = p.snd
+	p.snd = p.spare
+	p.spare = p.fading
+	
+	p.snd.SetState(gst.STATE_NULL)
+	p.snd.SetProperty("uri", makeURI(s.Value))
+	p.snd.SetProperty("volume", 0.0)
+	p.snd.SetProperty("mute", p.muted)
+	p.snd.SetState(gst.STATE_PLAYING)
+	
+	p.pushHistory(s)
+	p.setCurrent(s)
+	
+	p.fadeStart = time.Now()
+	p.fadeTicker = time.NewTicker(FadeStep)
+	p.fadeTick = p.fadeTicker.C
+}
+
+func (p *Player) stepFade() {
+	length := time.Duration(p.crossfade) * time.Second
+	done := float64(time.Since(p.fadeStart)) / float64(length)
+	if length <= 0 || done >= 1 {
+		p.StopFade()
+		return
+	}
+	
+	volume := float64(p.volume) / 100
+	p.fading.SetProperty("volume", volume * (1 - done))
+	p.snd.SetProperty("volume", volume * done)
+}
+
+/* Finishes a crossfade straight away. */
+func (p *Player) StopFade() {
+	if p.fading == nil {
+		return
+	}
+	
+	p.fadeTicker.Stop()
+	p.fadeTick = nil
+	p.fading.SetState(gst.STATE_NULL)
+	p.fading = nil
+	p.applyVolume()
+}
+
+func (p *Player) checkFade() {
+	if p.crossfade == 0 || p.fading != nil || p.queued != nil ||
+	   p.paused || p.stopped || p.stopAfter || p.current == nil {
+		return
+	}
+	
+	position, duration := p.Position()
+	length := time.Duration(p.crossfade) * time.Second
+	if position > 0 && duration > 0 && duration - position <= length {
+		p.StartFade()
+	}
+}
+
+func listenFifo(p *Player, c chan string) {
 	for {
 		in, err := os.Open(p.tmpDir + SuffixIn)
 		if err != nil {
 			panic(err)
 		}
 
-		n, err := in.Read(data)
-		if n > 0 && err != nil {
-			panic(err)
+		/* One command per line, read until every writer is done. */
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			c <- scanner.Text()
 		}
 		
 		in.Close()
-		
-		str := string(data[:n])
-		for _, name := range strings.Fields(str) {
-			c <- name
-		}
 	}
 }
 
-func listenBus(p *Player, c chan *gst.Message) {
+/* Blocks until a message arrives and passes every one on, Run decides
+ * what it cares about. */
+func listenBus(snd *gst.Element, c chan busMessage) {
+	bus := snd.GetBus()
 	for {
-		time.Sleep(time.Second)
-		mesg := p.bus.TimedPop(100000000)
+		mesg := bus.TimedPop(BusWaitForever)
 		if mesg != nil {
-			c <- mesg
+			c <- busMessage{snd, mesg}
 		}
 	}
 }
 
-func doFunction(p *Player, mesg string) {
-	if mesg == "exit" {
+/* Commands that take no arguments. Lines used to be split on spaces
+ * with each word a command, so one with more is an error rather than
+ * half carried out. */
+var noArgCommands = map[string]bool{
+	"exit": true, "next": true, "prev": true, "random": true,
+	"normal": true, "repeatall": true, "repeatone": true, "once": true,
+	"stopafter": true, "continue": true, "stop": true, "play": true,
+	"pause": true, "resume": true, "increase": true, "decrease": true,
+	"mute": true, "unmute": true, "clearfailed": true, "reload": true,
+	"reload-config": true,
+}
+
+func doFunction(p *Player, args []string) error {
+	if len(args) == 0 {
+		return nil
+	} else if noArgCommands[args[0]] && len(args) > 1 {
+		return fmt.Errorf("usage: %s (takes no arguments, one command per line)", args[0])
+	}
+	
+	/* Paths and uris end up as lines in files, one with a newline in it
+	 * would be two. */
+	for _, arg := range args {
+		if strings.ContainsAny(arg, "\r\n") {
+			return fmt.Errorf("%s: arguments can't have newlines in them", args[0])
+		}
+	}
+	
+	switch args[0] {
+	case "exit":
 		p.Exit()
-	} else if mesg == "next" {
+	case "next":
 		p.PlayNext()
-	} else if mesg == "random" {
+	case "prev":
+		p.PlayPrev()
+	case "random":
 		p.SetModeRandom()
-	} else if mesg == "normal" {
+	case "normal":
 		p.SetModeNormal()
-	} else if mesg == "pause" {
+	case "repeatall":
+		p.SetRepeat(RepeatAll)
+	case "repeatone":
+		p.SetRepeat(RepeatOne)
+	case "once":
+		p.SetRepeat(RepeatOnce)
+	case "stopafter":
+		p.SetStopAfter(true)
+	case "continue":
+		p.SetStopAfter(false)
+	case "stop":
+		p.Stop(false)
+	case "play":
+		p.Start()
+	case "pause":
 		p.Pause()
-	} else if mesg == "resume" {
+	case "resume":
 		p.Resume()
+	case "increase":
+		p.SetVolume(p.volume + VolumeStep)
+	case "decrease":
+		p.SetVolume(p.volume - VolumeStep)
+	case "volume":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: volume N")
+		}
+		volume, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("volume: invalid level %q", args[1])
+		}
+		p.SetVolume(volume)
+	case "mute":
+		p.Mute()
+	case "unmute":
+		p.Unmute()
+	case "crossfade":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: crossfade N")
+		}
+		secs, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("crossfade: invalid length %q", args[1])
+		}
+		p.SetCrossfade(secs)
+	case "save":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: save playlist|upcoming FILE")
+		}
+		return p.SavePlaylist(args[1], args[2])
+	case "clearfailed":
+		p.ClearFailed()
+	case "reload":
+		return p.Reload()
+	case "reload-config":
+		return p.ReloadConfig()
+	case "load":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: load PLAYLIST")
+		}
+		return p.Load(args[1])
+	case "append":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: append PLAYLIST")
+		}
+		return p.Append(args[1])
+	case "add":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: add PATH")
+		}
+		return p.Add(args[1])
+	case "seek":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: seek [+|-]TIME")
+		}
+		return p.SeekTo(args[1])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	
+	return nil
+}
+
+func (p *Player) writeFailed() {
+	var data string
+	for value := range p.failed {
+		data += value + "\n"
+	}
+	writeStringToValue(p.tmpDir + SuffixFailed, data)
+}
+
+func (p *Player) ClearFailed() {
+	p.failures = make(map[string]int)
+	p.failed = make(map[string]bool)
+	p.errorsInRow = 0
+	p.writeFailed()
+}
+
+/* The current song could not be played. Note why, blacklist it if it
+ * keeps failing and move on, slowly if nothing seems to work. */
+func (p *Player) Failed(mesg *gst.Message) {
+	/* A song set up for a gapless switch can fail before it starts, it
+	 * is that one that failed rather than the one still playing. */
+	var value string
+	if p.queued != nil {
+		value = p.queued.Value
+		p.queued = nil
+	} else if p.unqueued != nil {
+		value = p.unqueued.Value
+		p.unqueued = nil
+	} else if p.current != nil {
+		value = p.current.Value
+	}
+	
+	err, debug := mesg.ParseError()
+	line := fmt.Sprintf("%s: %s", makeURI(value), err)
+	log.Println(line)
+	if debug != "" {
+		log.Println(debug)
+	}
+	
+	p.errors = append(p.errors, line)
+	if len(p.errors) > ErrorsSize {
+		p.errors = p.errors[len(p.errors)-ErrorsSize:]
+	}
+	writeLinesToValue(p.tmpDir + SuffixErrors, p.errors)
+	
+	p.failures[value]++
+	if p.failures[value] >= MaxFailures && !p.failed[value] {
+		p.failed[value] = true
+		p.writeFailed()
+	}
+	
+	p.errorsInRow++
+	if p.errorsInRow < BackoffAfter {
+		p.PlayNext()
+		return
+	}
+	
+	wait := time.Second << uint(p.errorsInRow - BackoffAfter)
+	if wait > MaxBackoff || wait <= 0 {
+		wait = MaxBackoff
+	}
+	log.Println(p.errorsInRow, "errors in a row, waiting", wait)
+	p.snd.SetState(gst.STATE_NULL)
+	p.retry = time.After(wait)
+}
+
+/* Once something actually plays forget about earlier errors. */
+func (p *Player) checkErrors() {
+	if p.current == nil {
+		return
+	}
+	
+	position, _ := p.Position()
+	if position > 0 {
+		p.errorsInRow = 0
+		delete(p.failures, p.current.Value)
+	}
+}
+
+/* Tags come in bits as the stream is read, add to what we have. */
+func (p *Player) AddTags(tags *gst.TagList) {
+	strs := map[string]string{
+		"title": "title",
+		"artist": "artist",
+		"album": "album",
+		"genre": "genre",
+		"audio-codec": "codec",
+	}
+	uints := map[string]string{
+		"track-number": "track",
+		"bitrate": "bitrate",
+	}
+	
+	for tag, name := range strs {
+		value, ok := tags.GetString(tag)
+		if ok && value != "" {
+			p.metadata[name] = value
+		}
+	}
+	for tag, name := range uints {
+		value, ok := tags.GetUint(tag)
+		if ok && value > 0 {
+			p.metadata[name] = strconv.FormatUint(uint64(value), 10)
+		}
+	}
+	
+	writeStringToValue(p.tmpDir + SuffixMetadata, p.metadata.String())
+	p.notify(EventPlayer)
+}
+
+func (p *Player) handleMessage(snd *gst.Element, mesg *gst.Message) {
+	t := mesg.GetType()
+	if snd == p.fading {
+		if t == gst.MESSAGE_EOS || t == gst.MESSAGE_ERROR {
+			p.StopFade()
+		}
+		return
+	} else if snd != p.snd {
+		return
+	}
+	
+	switch t {
+	case gst.MESSAGE_EOS:
+		p.Advance()
+	case gst.MESSAGE_ERROR:
+		p.Failed(mesg)
+	case gst.MESSAGE_WARNING:
+		err, _ := mesg.ParseWarning()
+		log.Println("gstreamer warning:", err)
+	case gst.MESSAGE_STREAM_START:
+		p.StartQueued()
+	case gst.MESSAGE_TAG:
+		tags := mesg.ParseTag()
+		if tags != nil && p.metadata != nil {
+			p.AddTags(tags)
+		}
+	case gst.MESSAGE_ASYNC_DONE:
+		/* Prerolled or finished seeking, so the position and duration
+		 * can be known now. */
+		p.checkResume()
+		p.UpdatePosition()
 	}
 }
 
 func (p *Player) Run() {
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
+	hupChan := make(chan os.Signal, 1)
 	fifoChan := make(chan string)
-	busChan := make(chan *gst.Message)
+	busChan := make(chan busMessage, 16)
+	ticker := time.NewTicker(time.Second)
 	
 	signal.Notify(sigChan, syscall.SIGTERM)
 	signal.Notify(sigChan, syscall.SIGINT)
+	signal.Notify(hupChan, syscall.SIGHUP)
 	
 	go listenFifo(p, fifoChan)
-	go listenBus(p, busChan)
+	go listenBus(p.snd, busChan)
+	go listenBus(p.spare, busChan)
 	
 	for {
 		select {
 		case _ = <- sigChan:
 			p.Exit()
-		case mesg := <- fifoChan:
-			doFunction(p, mesg)
-		case mesg := <- busChan:
-			t := mesg.GetType()
-			if t == gst.MESSAGE_EOS || t == gst.MESSAGE_ERROR {
-				p.PlayNext()
+		case _ = <- hupChan:
+			err := p.Reload()
+			if err != nil {
+				log.Println(err)
+			}
+		case line := <- fifoChan:
+			args, err := splitArgs(line)
+			if err == nil {
+				err = doFunction(p, args)
+			}
+			if err != nil {
+				log.Println(err)
+			}
+		case _ = <- ticker.C:
+			p.checkUpcoming()
+			if !p.paused && !p.stopped {
+				p.UpdatePosition()
+				p.checkErrors()
+				p.checkFade()
 			}
+		case r := <- p.indexed:
+			if r.gen == p.indexGen {
+				p.index = r.index
+				p.writeIndex()
+			}
+		case lib := <- p.reloaded:
+			p.finishReload(lib)
+		case e := <- p.watchEvents:
+			p.watchChanged(e)
+		case f := <- p.calls:
+			f()
+		case _ = <- p.retry:
+			p.retry = nil
+			p.PlayNext()
+		case _ = <- p.fadeTick:
+			p.stepFade()
+		case req := <- p.finishing:
+			/* Crossfading takes care of its own switches. */
+			if req.snd == p.snd && p.crossfade == 0 {
+				req.reply <- p.QueueNext()
+			} else {
+				req.reply <- ""
+			}
+		case m := <- busChan:
+			p.handleMessage(m.snd, m.mesg)
 		}
 	}
 }
 
 func (p *Player) populateTmp() {
 	var f *os.File
-	_, err := os.Stat(p.tmpDir)
-	if err == nil { /* File exits? */
-		fmt.Println("tmp dir:", p.tmpDir, "exists.")
-		os.Exit(1)
-	}
+	p.claimTmp()
 	
 	/* Just hope there are no errors. */
-	os.Mkdir(p.tmpDir, 0700)
 	syscall.Mkfifo(p.tmpDir + SuffixIn, 0700)
 	
 	f, _ = os.Create(p.tmpDir + SuffixUpcoming)
 	f.Close()
 	f, _ = os.Create(p.tmpDir + SuffixPlaying)
 	f.Close()
+	f, _ = os.Create(p.tmpDir + SuffixHistory)
+	f.Close()
 }
 
-func (p *Player) initGst(nsink string) {
-	p.snd = gst.ElementFactoryMake("playbin", "mmusic")
-	if p.snd == nil {
+func (p *Player) newPlaybin(name string, nsink string) *gst.Element {
+	snd := gst.ElementFactoryMake("playbin", name)
+	if snd == nil {
 		fmt.Println("Failed to initialize gst: snd")
 		os.Exit(1)
 	}
 	
-	sink := gst.ElementFactoryMake(nsink, "Sink")
+	sink := gst.ElementFactoryMake(nsink, name + "-sink")
 	if sink == nil {
 		fmt.Println("Failed to initilize gst: ", nsink)
 		os.Exit(1)
 	}
-	p.snd.Link(sink)
+	for _, prop := range p.sinkProps {
+		sink.SetProperty(prop.name, propertyValue(prop.value))
+	}
+	snd.Link(sink)
 	
-	p.bus = p.snd.GetBus()
-	if p.bus == nil {
+	snd.ConnectNoi("about-to-finish", func() {
+		p.aboutToFinish(snd)
+	}, nil)
+	
+	if snd.GetBus() == nil {
 		fmt.Println("Failed to open gstreamer bus!")
 		os.Exit(1)
 	}
 	
-	p.snd.SetProperty("volume", 1.0)
+	return snd
+}
+
+func (p *Player) initGst(nsink string) {
+	p.finishing = make(chan *finishRequest)
+	p.snd = p.newPlaybin("mmusic", nsink)
+	p.spare = p.newPlaybin("mmusic-spare", nsink)
 }
 
 func main () {
@@ -410,44 +1467,115 @@ func main () {
 	tmpDir	:= flag.String("t", defaultTmp, "Set tmp directory.")
 	nsink	:= flag.String("l", "alsasink", "Change gstreamer sink.")
 	random	:= flag.Bool("r", true, "Set starting randomness.")
+	volume	:= flag.Int("v", 100, "Set starting volume (0-100).")
+	crossfade := flag.Int("x", 0, "Crossfade between songs for this many seconds.")
+	index	:= flag.Bool("i", true, "Index the tags of the library.")
+	cache	:= flag.String("c", defaultCachePath(), "Set library cache file, empty to not use one.")
+	rebuild	:= flag.Bool("C", false, "Rebuild the library cache.")
+	types	:= flag.String("types", DefaultAudioTypes, "Set file types added from directories.")
+	watch	:= flag.Bool("w", false, "Watch library directories for changes.")
+	mpd	:= flag.String("mpd", "", "Serve the MPD protocol on this address (host:port or a socket path).")
+	httpAddr := flag.String("http", "", "Serve the HTTP API on this address (localhost:port or a socket path).")
+	mpris	:= flag.Bool("mpris", true, "Provide MPRIS on the session bus.")
+	state	:= flag.String("s", defaultStatePath(), "Set file the state is saved to on exit, empty to not save it.")
+	resume	:= flag.Bool("resume", false, "Carry on from the saved state.")
+	logFile	:= flag.String("log", "", "Write the log to this file rather than stderr.")
+	config	:= flag.String("config", defaultConfigPath(), "Set config file, empty to not read one.")
 
 	flag.Parse()
 	
 	p := new(Player)
+	p.explicit = explicitFlags()
+	p.configPath = *config
+	conf := &Config{}
+	if *config != "" {
+		var err error
+		conf, err = readConfig(*config)
+		if err == nil {
+			err = conf.setFlags(p.explicit)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	p.sinkProps = conf.sinkProps
+	err := p.setLog(*logFile)
+	if err != nil {
+		fmt.Println("log:", err)
+		os.Exit(1)
+	}
+	
+	p.started = time.Now()
 	p.tmpDir = *tmpDir
+	p.statePath = *state
 	p.songs = new(Song)
+	p.failures = make(map[string]int)
+	p.failed = make(map[string]bool)
+	p.indexed = make(chan *indexResult)
+	p.reloaded = make(chan *Library)
+	p.calls = make(chan func())
 	p.initGst(*nsink)
 	p.populateTmp()
+	err = p.listenSocket()
+	if err != nil {
+		log.Println("socket:", err)
+	}
+	if *mpd != "" {
+		err = p.ListenMPD(*mpd)
+		if err != nil {
+			log.Println("mpd:", err)
+		}
+	}
+	if *httpAddr != "" {
+		err = p.ListenHTTP(*httpAddr)
+		if err != nil {
+			log.Println("http:", err)
+		}
+	}
 	if *random {
 		p.SetModeRandom()
 	}
-
-	for _, name := range flag.Args() {
-		f, err := os.Open(name)
+	p.SetVolume(*volume)
+	p.SetCrossfade(*crossfade)
+	
+	if *cache != "" {
+		libraryCache = OpenLibraryCache(*cache, *rebuild)
+	}
+	SetAudioTypes(*types)
+	
+	p.playlists = flag.Args()
+	if len(p.playlists) == 0 {
+		p.playlists = conf.playlists
+	}
+	p.indexing = *index
+	if *watch {
+		err := p.StartWatching()
 		if err != nil {
-			panic(err)
+			log.Println(err)
 		}
-		
-		var t *Song
-		for t = p.songs; t != nil && t.Next != nil; t = t.Next {}
-		
-		t.Next = scan(f)
-		
-		f.Close()
 	}
-	
-	playlist, err := os.Create(p.tmpDir + SuffixPlaylist)
-	if err != nil {
-		panic(err)
+	lib := loadLibrary(p.playlists, nil)
+	if lib.err != nil {
+		panic(lib.err)
 	}
+	p.setLibrary(lib)
 	
-	for s := p.songs.Next; s != nil; s = s.Next {
-		p.size++
-		playlist.WriteString(s.Value + "\n")
+	if *mpris {
+		err = p.StartMPRIS()
+		if err != nil {
+			log.Println("mpris:", err)
+		}
 	}
 	
-	playlist.Close()
-
-	p.PlayNext()
+	if *resume && *state != "" {
+		err = p.RestoreState(*state)
+		if err != nil {
+			log.Println("restoring state:", err)
+			p.PlayNext()
+		}
+	} else {
+		p.PlayNext()
+	}
 	p.Run()
 }
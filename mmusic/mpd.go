@@ -0,0 +1,1051 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Enough of the MPD protocol for MPD clients to control mmusic, with
+ * -mpd. See https://mpd.readthedocs.io/en/latest/protocol.html
+ *
+ * MPD's queue is the current song followed by upcoming, so it behaves
+ * like MPD with consume on: songs leave the queue once they've played.
+ * When upcoming runs out mmusic carries on picking from the library as
+ * usual. */
+
+var MPDVersion = "0.21.0"
+
+const (
+	mpdErrorArg = 2
+	mpdErrorUnknown = 5
+	mpdErrorNoExist = 50
+	mpdErrorSystem = 52
+)
+
+type mpdError struct {
+	code int
+	mesg string
+}
+
+func (e *mpdError) Error() string {
+	return e.mesg
+}
+
+func mpdArgError(format string, a ...interface{}) error {
+	return &mpdError{mpdErrorArg, fmt.Sprintf(format, a...)}
+}
+
+/* The queue as MPD clients see it. Song ids stay with a song as other
+ * songs are added and removed around it, version changes whenever the
+ * queue does. */
+type mpdQueue struct {
+	version int
+	values []string
+	ids []int
+	nextID int
+}
+
+type mpdEntry struct {
+	song *Song
+	id int
+}
+
+func (p *Player) ListenMPD(addr string) error {
+	listener, err := netListen(addr)
+	if err != nil {
+		return err
+	}
+
+	p.mpd = &mpdQueue{version: 1, nextID: 1}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Println("mpd:", err)
+				return
+			}
+			go p.serveMPD(conn)
+		}
+	}()
+	return nil
+}
+
+func (p *Player) findSong(value string) *Song {
+	for s := p.songs.Next; s != nil; s = s.Next {
+		if s.Value == value {
+			return s
+		}
+	}
+	return &Song{Value: value}
+}
+
+func (p *Player) readUpcoming() []string {
+	var lines []string
+	for _, s := range p.upcomingSongs() {
+		lines = append(lines, s.Value)
+	}
+	return lines
+}
+
+func (p *Player) writeUpcoming(lines []string) {
+	writeLinesToValue(p.tmpDir + SuffixUpcoming, lines)
+	p.checkUpcoming()
+}
+
+/* Whether the current song is in the queue, a song that played to the
+ * end before stopping isn't. */
+func (p *Player) currentQueued() bool {
+	return p.current != nil && !(p.stopped && p.finished)
+}
+
+/* Gives each of values the id it had in the last queue, matching them up
+ * in order so songs keep theirs when others are added or removed around
+ * them, and new ids to the rest. */
+func (q *mpdQueue) assignIDs(values []string) []int {
+	ids := make([]int, len(values))
+	old := q.values
+
+	/* Usually only a little changes, at the start or the end. */
+	start := 0
+	for start < len(values) && start < len(old) && values[start] == old[start] {
+		ids[start] = q.ids[start]
+		start++
+	}
+	end := 0
+	for end < len(values) - start && end < len(old) - start &&
+	    values[len(values)-1-end] == old[len(old)-1-end] {
+		ids[len(values)-1-end] = q.ids[len(old)-1-end]
+		end++
+	}
+
+	/* Longest common subsequence of what's left. */
+	a, b := values[start:len(values)-end], old[start:len(old)-end]
+	lcs := make([][]int, len(a) + 1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b) + 1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] > lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		if a[i] == b[j] {
+			ids[start+i] = q.ids[start+j]
+			i++
+			j++
+		} else if lcs[i+1][j] >= lcs[i][j+1] {
+			i++
+		} else {
+			j++
+		}
+	}
+
+	for i := range ids {
+		if ids[i] == 0 {
+			ids[i] = q.nextID
+			q.nextID++
+		}
+	}
+	return ids
+}
+
+func (p *Player) mpdQueue() []mpdEntry {
+	var songs []*Song
+	if p.currentQueued() {
+		songs = append(songs, p.current)
+	}
+	songs = append(songs, p.upcomingSongs()...)
+
+	values := make([]string, len(songs))
+	for i, s := range songs {
+		values[i] = s.Value
+	}
+
+	q := p.mpd
+	ids := q.assignIDs(values)
+	changed := len(ids) != len(q.ids)
+	entries := make([]mpdEntry, len(songs))
+	for i, s := range songs {
+		entries[i] = mpdEntry{s, ids[i]}
+		if !changed && ids[i] != q.ids[i] {
+			changed = true
+		}
+	}
+
+	if changed {
+		q.version++
+		q.values = values
+		q.ids = ids
+	}
+	return entries
+}
+
+/* What MPD calls the tags we have, in the order they're given. */
+var mpdTagNames = []string{"artist", "album", "title", "track", "genre"}
+var mpdTags = map[string]string{
+	"artist": "Artist",
+	"album": "Album",
+	"title": "Title",
+	"track": "Track",
+	"genre": "Genre",
+}
+
+func (p *Player) writeMPDSong(out *bytes.Buffer, s *Song) {
+	tags := Tags{}
+	for k, v := range p.index[s.Value] {
+		tags[k] = v
+	}
+	duration := s.Duration
+	if s == p.current {
+		for k, v := range p.metadata {
+			tags[k] = v
+		}
+		_, d := p.Position()
+		if d > 0 {
+			duration = d
+		}
+	}
+	if tags["title"] == "" && s.Title != "" {
+		tags["title"] = s.Title
+	}
+
+	fmt.Fprintf(out, "file: %s\n", s.Value)
+	for _, name := range mpdTagNames {
+		if tags[name] != "" {
+			fmt.Fprintf(out, "%s: %s\n", mpdTags[name], tags[name])
+		}
+	}
+	if duration > 0 {
+		fmt.Fprintf(out, "Time: %d\nduration: %.3f\n",
+		            int64(duration.Seconds()), duration.Seconds())
+	}
+}
+
+func (p *Player) writeMPDEntry(out *bytes.Buffer, pos int, e mpdEntry) {
+	p.writeMPDSong(out, e.song)
+	fmt.Fprintf(out, "Pos: %d\nId: %d\n", pos, e.id)
+}
+
+func mpdBool(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func parseMPDBool(arg string) (bool, error) {
+	switch arg {
+	case "0":
+		return false, nil
+	case "1":
+		return true, nil
+	}
+	return false, mpdArgError("Boolean (0/1) expected: %s", arg)
+}
+
+func parseMPDInt(arg string) (int, error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, mpdArgError("Integer expected: %s", arg)
+	}
+	return n, nil
+}
+
+func parseMPDTime(arg string) (time.Duration, error) {
+	secs, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		return 0, mpdArgError("Number expected: %s", arg)
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+/* "N" or "START:END", END may be left out to go to the end. Returns the
+ * range as [start, end) within a queue of n songs. */
+func parseMPDRange(arg string, n int) (int, int, error) {
+	i := strings.Index(arg, ":")
+	if i < 0 {
+		pos, err := parseMPDInt(arg)
+		if err != nil {
+			return 0, 0, err
+		} else if pos < 0 || pos >= n {
+			return 0, 0, mpdArgError("Bad song index")
+		}
+		return pos, pos + 1, nil
+	}
+
+	start, err := parseMPDInt(arg[:i])
+	if err != nil {
+		return 0, 0, err
+	}
+	end := n
+	if arg[i+1:] != "" {
+		end, err = parseMPDInt(arg[i+1:])
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if end > n {
+		end = n
+	}
+	if start < 0 || start > end {
+		return 0, 0, mpdArgError("Bad song index")
+	}
+	return start, end, nil
+}
+
+/* Finds the position of the song with the id in arg. */
+func mpdFindID(queue []mpdEntry, arg string) (int, error) {
+	id, err := parseMPDInt(arg)
+	if err != nil {
+		return 0, err
+	}
+	for i, e := range queue {
+		if e.id == id {
+			return i, nil
+		}
+	}
+	return 0, &mpdError{mpdErrorNoExist, "No such song"}
+}
+
+/* Converts a queue position to one in upcoming. */
+func (p *Player) upcomingIndex(pos int) int {
+	if p.currentQueued() {
+		return pos - 1
+	}
+	return pos
+}
+
+/* Plays the song at pos in the queue. */
+func (p *Player) mpdPlay(pos int) error {
+	i := p.upcomingIndex(pos)
+	if i < 0 {
+		if p.stopped || p.paused {
+			p.Start()
+		} else {
+			p.Play(p.current)
+		}
+		return nil
+	}
+
+	upcoming := p.readUpcoming()
+	if i >= len(upcoming) {
+		return mpdArgError("Bad song index")
+	}
+	value := upcoming[i]
+	p.writeUpcoming(append(upcoming[:i], upcoming[i+1:]...))
+
+	s := p.findSong(value)
+	p.pushHistory(s)
+	p.Play(s)
+	return nil
+}
+
+/* Removes the songs in [start, end) from the queue. */
+func (p *Player) mpdDelete(start, end int) {
+	/* Nothing to remove, and the current song isn't in it. */
+	if start >= end {
+		return
+	}
+
+	upcoming := p.readUpcoming()
+	skip := false
+	if p.currentQueued() {
+		skip = start == 0
+		start, end = start - 1, end - 1
+		if start < 0 {
+			start = 0
+		}
+	}
+	if end > len(upcoming) {
+		end = len(upcoming)
+	}
+	if start > end {
+		start = end
+	}
+
+	p.writeUpcoming(append(upcoming[:start], upcoming[end:]...))
+	if skip {
+		if p.stopped {
+			p.finished = true
+			p.notify(EventPlaylist)
+		} else {
+			p.PlayNext()
+		}
+	}
+}
+
+/* The audio files under dir, sorted as a scan would. Not read through
+ * the library cache, a reload could be using it from its own goroutine. */
+func mpdListDir(dir string) []string {
+	entries, err := listDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var values []string
+	for _, entry := range entries {
+		value := dir + "/" + entry.Name
+		if entry.IsDir {
+			values = append(values, mpdListDir(value)...)
+		} else if isAudio(value) {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+/* Adds value to upcoming at i, or the songs in it if it's a directory
+ * and single isn't set. */
+func (p *Player) mpdAdd(value string, i int, single bool) error {
+	if value == "" {
+		return mpdArgError("Nothing to add")
+	}
+
+	values := []string{value}
+	if !strings.Contains(value, "://") {
+		fi, err := os.Stat(value)
+		if err != nil {
+			return &mpdError{mpdErrorNoExist, "No such directory"}
+		} else if fi.IsDir() && single {
+			return mpdArgError("Only a single song can be added with addid")
+		} else if fi.IsDir() {
+			values = mpdListDir(value)
+		}
+	}
+
+	upcoming := p.readUpcoming()
+	if i < 0 || i > len(upcoming) {
+		i = len(upcoming)
+	}
+	lines := append([]string{}, upcoming[:i]...)
+	lines = append(lines, values...)
+	p.writeUpcoming(append(lines, upcoming[i:]...))
+	return nil
+}
+
+func (p *Player) mpdStatus(out *bytes.Buffer) {
+	queue := p.mpdQueue()
+
+	volume := p.volume
+	if p.muted {
+		volume = 0
+	}
+	fmt.Fprintf(out, "volume: %d\n", volume)
+	fmt.Fprintf(out, "repeat: %d\n", mpdBool(p.repeat != RepeatOnce))
+	fmt.Fprintf(out, "random: %d\n", mpdBool(p.random))
+	fmt.Fprintf(out, "single: %d\n", mpdBool(p.repeat == RepeatOne || p.stopAfter))
+	fmt.Fprintf(out, "consume: 1\n")
+	fmt.Fprintf(out, "playlist: %d\n", p.mpd.version)
+	fmt.Fprintf(out, "playlistlength: %d\n", len(queue))
+
+	state := "play"
+	if p.stopped {
+		state = "stop"
+	} else if p.paused {
+		state = "pause"
+	}
+	fmt.Fprintf(out, "state: %s\n", state)
+
+	if p.crossfade > 0 {
+		fmt.Fprintf(out, "xfade: %d\n", p.crossfade)
+	}
+
+	next := 0
+	if p.currentQueued() {
+		fmt.Fprintf(out, "song: 0\nsongid: %d\n", queue[0].id)
+		next = 1
+
+		if !p.stopped {
+			position, duration := p.Position()
+			fmt.Fprintf(out, "time: %d:%d\n", int64(position.Seconds()),
+			            int64(duration.Seconds()))
+			fmt.Fprintf(out, "elapsed: %.3f\n", position.Seconds())
+			if duration > 0 {
+				fmt.Fprintf(out, "duration: %.3f\n", duration.Seconds())
+			}
+		}
+
+		bitrate, err := strconv.Atoi(p.metadata["bitrate"])
+		if err == nil {
+			fmt.Fprintf(out, "bitrate: %d\n", bitrate / 1000)
+		}
+	}
+	if next < len(queue) {
+		fmt.Fprintf(out, "nextsong: %d\nnextsongid: %d\n", next, queue[next].id)
+	}
+}
+
+/* repeat and single together make mmusic's repeat modes: repeat is
+ * RepeatAll, repeat and single RepeatOne, single alone stop after. */
+func (p *Player) mpdSetModes(repeat, single bool) {
+	switch {
+	case repeat && single:
+		p.SetRepeat(RepeatOne)
+	case repeat:
+		p.SetRepeat(RepeatAll)
+	default:
+		p.SetRepeat(RepeatOnce)
+	}
+
+	p.SetStopAfter(single && !repeat)
+}
+
+func mpdArgs(args []string, min, max int) error {
+	if len(args) - 1 < min || len(args) - 1 > max {
+		return mpdArgError("wrong number of arguments for \"%s\"", args[0])
+	}
+	return nil
+}
+
+type mpdCommand struct {
+	min, max int
+	run func(p *Player, args []string, out *bytes.Buffer) error
+}
+
+var mpdCommands = map[string]mpdCommand{
+	"ping": {0, 0, func(p *Player, args []string, out *bytes.Buffer) error {
+		return nil
+	}},
+	"clearerror": {0, 0, func(p *Player, args []string, out *bytes.Buffer) error {
+		return nil
+	}},
+	"status": {0, 0, func(p *Player, args []string, out *bytes.Buffer) error {
+		p.mpdStatus(out)
+		return nil
+	}},
+	"stats": {0, 0, func(p *Player, args []string, out *bytes.Buffer) error {
+		fmt.Fprintf(out, "songs: %d\nuptime: %d\n", p.size,
+		            int64(time.Since(p.started).Seconds()))
+		return nil
+	}},
+	"currentsong": {0, 0, func(p *Player, args []string, out *bytes.Buffer) error {
+		queue := p.mpdQueue()
+		if p.currentQueued() {
+			p.writeMPDEntry(out, 0, queue[0])
+		}
+		return nil
+	}},
+	"play": {0, 1, func(p *Player, args []string, out *bytes.Buffer) error {
+		if len(args) == 1 {
+			p.Start()
+			return nil
+		}
+		pos, err := parseMPDInt(args[1])
+		if err != nil {
+			return err
+		} else if pos < 0 || pos >= len(p.mpdQueue()) {
+			return mpdArgError("Bad song index")
+		}
+		return p.mpdPlay(pos)
+	}},
+	"playid": {0, 1, func(p *Player, args []string, out *bytes.Buffer) error {
+		if len(args) == 1 {
+			p.Start()
+			return nil
+		}
+		pos, err := mpdFindID(p.mpdQueue(), args[1])
+		if err != nil {
+			return err
+		}
+		return p.mpdPlay(pos)
+	}},
+	"pause": {0, 1, func(p *Player, args []string, out *bytes.Buffer) error {
+		pause := !p.paused
+		if len(args) == 2 {
+			var err error
+			pause, err = parseMPDBool(args[1])
+			if err != nil {
+				return err
+			}
+		}
+		if pause {
+			p.Pause()
+		} else {
+			p.Resume()
+		}
+		return nil
+	}},
+	"stop": {0, 0, func(p *Player, args []string, out *bytes.Buffer) error {
+		if !p.stopped {
+			p.Stop(false)
+		}
+		return nil
+	}},
+	"next": {0, 0, func(p *Player, args []string, out *bytes.Buffer) error {
+		p.PlayNext()
+		return nil
+	}},
+	"previous": {0, 0, func(p *Player, args []string, out *bytes.Buffer) error {
+		p.PlayPrev()
+		return nil
+	}},
+	"setvol": {1, 1, func(p *Player, args []string, out *bytes.Buffer) error {
+		volume, err := parseMPDInt(args[1])
+		if err != nil {
+			return err
+		}
+		p.Unmute()
+		p.SetVolume(volume)
+		return nil
+	}},
+	"volume": {1, 1, func(p *Player, args []string, out *bytes.Buffer) error {
+		change, err := parseMPDInt(args[1])
+		if err != nil {
+			return err
+		}
+		p.SetVolume(p.volume + change)
+		return nil
+	}},
+	"getvol": {0, 0, func(p *Player, args []string, out *bytes.Buffer) error {
+		fmt.Fprintf(out, "volume: %d\n", p.volume)
+		return nil
+	}},
+	"seek": {2, 2, func(p *Player, args []string, out *bytes.Buffer) error {
+		pos, _, err := parseMPDRange(args[1], len(p.mpdQueue()))
+		if err != nil {
+			return err
+		}
+		return p.mpdSeek(pos, args[2])
+	}},
+	"seekid": {2, 2, func(p *Player, args []string, out *bytes.Buffer) error {
+		pos, err := mpdFindID(p.mpdQueue(), args[1])
+		if err != nil {
+			return err
+		}
+		return p.mpdSeek(pos, args[2])
+	}},
+	"seekcur": {1, 1, func(p *Player, args []string, out *bytes.Buffer) error {
+		if !p.currentQueued() || p.stopped {
+			return &mpdError{mpdErrorNoExist, "Not playing"}
+		}
+		arg := args[1]
+		if arg[0] == '+' || arg[0] == '-' {
+			offset, err := parseMPDTime(arg)
+			if err != nil {
+				return err
+			}
+			position, _ := p.Position()
+			p.Seek(position + offset)
+			return nil
+		}
+		return p.mpdSeek(0, arg)
+	}},
+	"playlistinfo": {0, 1, func(p *Player, args []string, out *bytes.Buffer) error {
+		queue := p.mpdQueue()
+		start, end := 0, len(queue)
+		if len(args) == 2 {
+			var err error
+			start, end, err = parseMPDRange(args[1], len(queue))
+			if err != nil {
+				return err
+			}
+		}
+		for i := start; i < end; i++ {
+			p.writeMPDEntry(out, i, queue[i])
+		}
+		return nil
+	}},
+	"playlistid": {0, 1, func(p *Player, args []string, out *bytes.Buffer) error {
+		queue := p.mpdQueue()
+		if len(args) == 1 {
+			for i, e := range queue {
+				p.writeMPDEntry(out, i, e)
+			}
+			return nil
+		}
+		pos, err := mpdFindID(queue, args[1])
+		if err != nil {
+			return err
+		}
+		p.writeMPDEntry(out, pos, queue[pos])
+		return nil
+	}},
+	"plchanges": {1, 2, func(p *Player, args []string, out *bytes.Buffer) error {
+		queue := p.mpdQueue()
+		version, err := parseMPDInt(args[1])
+		if err != nil {
+			return err
+		}
+		/* Everything has changed if anything has. */
+		if version != p.mpd.version {
+			for i, e := range queue {
+				p.writeMPDEntry(out, i, e)
+			}
+		}
+		return nil
+	}},
+	"plchangesposid": {1, 2, func(p *Player, args []string, out *bytes.Buffer) error {
+		queue := p.mpdQueue()
+		version, err := parseMPDInt(args[1])
+		if err != nil {
+			return err
+		}
+		if version != p.mpd.version {
+			for i, e := range queue {
+				fmt.Fprintf(out, "cpos: %d\nId: %d\n", i, e.id)
+			}
+		}
+		return nil
+	}},
+	"add": {1, 1, func(p *Player, args []string, out *bytes.Buffer) error {
+		return p.mpdAdd(args[1], -1, false)
+	}},
+	"addid": {1, 2, func(p *Player, args []string, out *bytes.Buffer) error {
+		queue := p.mpdQueue()
+		pos := len(queue)
+		if len(args) == 3 {
+			var err error
+			pos, err = parseMPDInt(args[2])
+			if err != nil {
+				return err
+			} else if pos < 0 || pos > len(queue) {
+				return mpdArgError("Bad song index")
+			}
+		}
+		i := p.upcomingIndex(pos)
+		if i < 0 {
+			i = 0
+		}
+
+		err := p.mpdAdd(args[1], i, true)
+		if err != nil {
+			return err
+		}
+
+		queue = p.mpdQueue()
+		if p.currentQueued() {
+			i++
+		}
+		fmt.Fprintf(out, "Id: %d\n", queue[i].id)
+		return nil
+	}},
+	"clear": {0, 0, func(p *Player, args []string, out *bytes.Buffer) error {
+		p.writeUpcoming(nil)
+		p.Stop(true)
+		return nil
+	}},
+	"delete": {1, 1, func(p *Player, args []string, out *bytes.Buffer) error {
+		start, end, err := parseMPDRange(args[1], len(p.mpdQueue()))
+		if err != nil {
+			return err
+		}
+		p.mpdDelete(start, end)
+		return nil
+	}},
+	"deleteid": {1, 1, func(p *Player, args []string, out *bytes.Buffer) error {
+		pos, err := mpdFindID(p.mpdQueue(), args[1])
+		if err != nil {
+			return err
+		}
+		p.mpdDelete(pos, pos + 1)
+		return nil
+	}},
+	"random": {1, 1, func(p *Player, args []string, out *bytes.Buffer) error {
+		random, err := parseMPDBool(args[1])
+		if err != nil {
+			return err
+		} else if random {
+			p.SetModeRandom()
+		} else {
+			p.SetModeNormal()
+		}
+		return nil
+	}},
+	"repeat": {1, 1, func(p *Player, args []string, out *bytes.Buffer) error {
+		repeat, err := parseMPDBool(args[1])
+		if err != nil {
+			return err
+		}
+		p.mpdSetModes(repeat, p.repeat == RepeatOne || p.stopAfter)
+		return nil
+	}},
+	"single": {1, 1, func(p *Player, args []string, out *bytes.Buffer) error {
+		single, err := parseMPDBool(args[1])
+		if err != nil {
+			return err
+		}
+		p.mpdSetModes(p.repeat != RepeatOnce, single)
+		return nil
+	}},
+	"consume": {1, 1, func(p *Player, args []string, out *bytes.Buffer) error {
+		consume, err := parseMPDBool(args[1])
+		if err != nil {
+			return err
+		} else if !consume {
+			return &mpdError{mpdErrorSystem, "Songs always leave the queue once played"}
+		}
+		return nil
+	}},
+	"crossfade": {1, 1, func(p *Player, args []string, out *bytes.Buffer) error {
+		secs, err := parseMPDInt(args[1])
+		if err != nil {
+			return err
+		}
+		p.SetCrossfade(secs)
+		return nil
+	}},
+	"outputs": {0, 0, func(p *Player, args []string, out *bytes.Buffer) error {
+		fmt.Fprintf(out, "outputid: 0\noutputname: mmusic\noutputenabled: 1\n")
+		return nil
+	}},
+	"tagtypes": {0, 0, func(p *Player, args []string, out *bytes.Buffer) error {
+		for _, name := range mpdTagNames {
+			fmt.Fprintf(out, "tagtype: %s\n", mpdTags[name])
+		}
+		return nil
+	}},
+	"listallinfo": {0, 1, func(p *Player, args []string, out *bytes.Buffer) error {
+		for s := p.songs.Next; s != nil; s = s.Next {
+			if len(args) == 1 || strings.HasPrefix(s.Value, args[1]) {
+				p.writeMPDSong(out, s)
+			}
+		}
+		return nil
+	}},
+	"listall": {0, 1, func(p *Player, args []string, out *bytes.Buffer) error {
+		for s := p.songs.Next; s != nil; s = s.Next {
+			if len(args) == 1 || strings.HasPrefix(s.Value, args[1]) {
+				fmt.Fprintf(out, "file: %s\n", s.Value)
+			}
+		}
+		return nil
+	}},
+	"urlhandlers": {0, 0, func(p *Player, args []string, out *bytes.Buffer) error {
+		return nil
+	}},
+	"decoders": {0, 0, func(p *Player, args []string, out *bytes.Buffer) error {
+		return nil
+	}},
+	"listplaylists": {0, 0, func(p *Player, args []string, out *bytes.Buffer) error {
+		return nil
+	}},
+}
+
+func (p *Player) mpdSeek(pos int, arg string) error {
+	if pos != 0 || !p.currentQueued() || p.stopped {
+		return mpdArgError("Can only seek in the current song")
+	}
+	position, err := parseMPDTime(arg)
+	if err != nil {
+		return err
+	}
+	p.Seek(position)
+	return nil
+}
+
+/* Runs one command, must be called from Run. */
+func (p *Player) mpdCommand(args []string, out *bytes.Buffer) error {
+	if args[0] == "commands" {
+		var names []string
+		for name := range mpdCommands {
+			names = append(names, name)
+		}
+		names = append(names, "commands", "notcommands", "idle", "noidle",
+		               "close", "command_list_begin",
+		               "command_list_ok_begin", "command_list_end")
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(out, "command: %s\n", name)
+		}
+		return nil
+	} else if args[0] == "notcommands" {
+		return nil
+	}
+
+	command, ok := mpdCommands[args[0]]
+	if !ok {
+		return &mpdError{mpdErrorUnknown, fmt.Sprintf("unknown command \"%s\"", args[0])}
+	}
+
+	err := mpdArgs(args, command.min, command.max)
+	if err != nil {
+		return err
+	}
+	return command.run(p, args, out)
+}
+
+/* A client connection. */
+type mpdClient struct {
+	p *Player
+	w *bufio.Writer
+	events chan string
+	/* Events since the client last idled. */
+	pending map[string]bool
+	/* What the client is waiting for while idle, nil when it isn't.
+	 * Empty for anything. */
+	idle map[string]bool
+}
+
+func (p *Player) serveMPD(conn net.Conn) {
+	defer conn.Close()
+
+	c := &mpdClient{
+		p: p,
+		w: bufio.NewWriter(conn),
+		pending: make(map[string]bool),
+	}
+	p.Call(func() {
+		c.events = p.Subscribe()
+	})
+	defer p.Call(func() {
+		p.Unsubscribe(c.events)
+	})
+
+	lines := make(chan string)
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	fmt.Fprintf(c.w, "OK MPD %s\n", MPDVersion)
+	c.w.Flush()
+
+	var list []string
+	inList, listOK := false, false
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+
+			switch {
+			case c.idle != nil:
+				/* Anything but noidle ends the connection. */
+				if line != "noidle" {
+					return
+				}
+				c.idle = nil
+				c.w.WriteString("OK\n")
+			case line == "noidle":
+				/* Not idle, so nothing to do. */
+			case inList && line == "command_list_end":
+				inList = false
+				if !c.run(list, listOK) {
+					return
+				}
+			case inList:
+				list = append(list, line)
+			case line == "command_list_begin", line == "command_list_ok_begin":
+				inList = true
+				listOK = line == "command_list_ok_begin"
+				list = nil
+			default:
+				if !c.run([]string{line}, false) {
+					return
+				}
+			}
+		case e := <-c.events:
+			c.pending[e] = true
+			c.checkIdle()
+		}
+
+		if c.w.Flush() != nil {
+			return
+		}
+	}
+}
+
+/* Runs the commands in lines, returning false if the connection should
+ * be closed. */
+func (c *mpdClient) run(lines []string, listOK bool) bool {
+	for i, line := range lines {
+		args, err := splitArgs(line)
+		if err != nil {
+			fmt.Fprintf(c.w, "ACK [%d@%d] {} %s\n", mpdErrorArg, i, err)
+			return true
+		} else if len(args) == 0 {
+			fmt.Fprintf(c.w, "ACK [%d@%d] {} No command given\n", mpdErrorUnknown, i)
+			return true
+		}
+
+		switch args[0] {
+		case "close":
+			return false
+		case "idle":
+			if len(lines) > 1 {
+				fmt.Fprintf(c.w, "ACK [%d@%d] {idle} idle in a command list\n",
+				            mpdErrorArg, i)
+				return true
+			}
+			c.idle = make(map[string]bool)
+			for _, name := range args[1:] {
+				c.idle[name] = true
+			}
+			c.checkIdle()
+			return true
+		}
+
+		var out bytes.Buffer
+		c.p.Call(func() {
+			err = c.p.mpdCommand(args, &out)
+		})
+
+		if err != nil {
+			code := mpdErrorSystem
+			if e, ok := err.(*mpdError); ok {
+				code = e.code
+			}
+			fmt.Fprintf(c.w, "ACK [%d@%d] {%s} %s\n", code, i, args[0], err)
+			return true
+		}
+
+		c.w.Write(out.Bytes())
+		if listOK {
+			c.w.WriteString("list_OK\n")
+		}
+	}
+
+	c.w.WriteString("OK\n")
+	return true
+}
+
+/* Answers an idle if anything it's waiting for has happened. */
+func (c *mpdClient) checkIdle() {
+	if c.idle == nil {
+		return
+	}
+
+	var changed []string
+	for name := range c.pending {
+		if len(c.idle) == 0 || c.idle[name] {
+			changed = append(changed, name)
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+
+	sort.Strings(changed)
+	for _, name := range changed {
+		fmt.Fprintf(c.w, "changed: %s\n", name)
+		delete(c.pending, name)
+	}
+	c.w.WriteString("OK\n")
+	c.idle = nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+/* A player with upcoming holding values and, if current isn't empty,
+ * that song stopped part way through so it is at the top of the queue.
+ * Nothing here starts playback. */
+func newMPDPlayer(t *testing.T, current string, values ...string) *Player {
+	dir, err := ioutil.TempDir("", "mmusic-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	p := &Player{tmpDir: dir, songs: new(Song), stopped: true}
+	p.mpd = &mpdQueue{version: 1, nextID: 1}
+	if current != "" {
+		p.current = &Song{Value: current}
+	} else {
+		p.finished = true
+	}
+	writeLinesToValue(dir + SuffixUpcoming, values)
+	return p
+}
+
+func TestParseMPDRange(t *testing.T) {
+	tests := []struct {
+		arg string
+		n int
+		start, end int
+		ok bool
+	}{
+		{"0", 3, 0, 1, true},
+		{"2", 3, 2, 3, true},
+		{"3", 3, 0, 0, false},
+		{"-1", 3, 0, 0, false},
+		{"0", 0, 0, 0, false},
+		{"1:3", 5, 1, 3, true},
+		{"1:", 5, 1, 5, true},
+		{"0:0", 5, 0, 0, true},
+		{"2:9", 5, 2, 5, true},
+		{"0:", 0, 0, 0, true},
+		{"3:1", 5, 0, 0, false},
+		{"6:", 5, 0, 0, false},
+		{"a:2", 5, 0, 0, false},
+		{"1:b", 5, 0, 0, false},
+		{"", 5, 0, 0, false},
+	}
+
+	for _, test := range tests {
+		start, end, err := parseMPDRange(test.arg, test.n)
+		if (err == nil) != test.ok {
+			t.Errorf("parseMPDRange(%q, %d): error %v", test.arg, test.n, err)
+		} else if test.ok && (start != test.start || end != test.end) {
+			t.Errorf("parseMPDRange(%q, %d) = %d, %d, want %d, %d",
+			         test.arg, test.n, start, end, test.start, test.end)
+		}
+	}
+}
+
+func TestAssignIDs(t *testing.T) {
+	q := &mpdQueue{version: 1, nextID: 1}
+	steps := []struct {
+		values []string
+		ids []int
+	}{
+		{[]string{"a", "b", "c"}, []int{1, 2, 3}},
+		/* Removed from the front, as when a song is played. */
+		{[]string{"b", "c"}, []int{2, 3}},
+		/* Added at the end. */
+		{[]string{"b", "c", "d"}, []int{2, 3, 4}},
+		/* A copy of c added before it gets a new id. */
+		{[]string{"b", "c", "c", "d"}, []int{2, 3, 5, 4}},
+		{[]string{"b", "x", "c", "c", "d"}, []int{2, 6, 3, 5, 4}},
+		/* Swapped, only one of them can keep its id. */
+		{[]string{"d", "b"}, []int{7, 2}},
+		{nil, []int{}},
+	}
+
+	for i, step := range steps {
+		ids := q.assignIDs(step.values)
+		if !reflect.DeepEqual(ids, step.ids) {
+			t.Fatalf("step %d: ids %v, want %v", i, ids, step.ids)
+		}
+		q.values, q.ids = step.values, ids
+	}
+}
+
+func TestMPDQueueIDs(t *testing.T) {
+	p := newMPDPlayer(t, "/m/a", "/m/b", "/m/c")
+	version := p.mpd.version
+
+	queue := p.mpdQueue()
+	if len(queue) != 3 || queue[0].song != p.current {
+		t.Fatalf("queue %v, want the current song then upcoming", queue)
+	}
+	if p.mpd.version == version {
+		t.Error("version didn't change with the queue")
+	}
+
+	version = p.mpd.version
+	p.mpdQueue()
+	if p.mpd.version != version {
+		t.Error("version changed without the queue changing")
+	}
+
+	pos, err := mpdFindID(queue, "3")
+	if err != nil || pos != 2 {
+		t.Errorf("mpdFindID(3) = %d, %v, want 2", pos, err)
+	}
+	if _, err := mpdFindID(queue, "9"); err == nil {
+		t.Error("mpdFindID found a song that isn't there")
+	}
+	if _, err := mpdFindID(queue, "x"); err == nil {
+		t.Error("mpdFindID took a bad id")
+	}
+}
+
+func TestMPDDelete(t *testing.T) {
+	tests := []struct {
+		current string
+		arg string
+		upcoming []string
+		/* Whether the current song is still in the queue. */
+		kept bool
+		ok bool
+	}{
+		{"/m/a", "0:0", []string{"/m/b", "/m/c"}, true, true},
+		{"/m/a", "1:1", []string{"/m/b", "/m/c"}, true, true},
+		{"/m/a", "1", []string{"/m/c"}, true, true},
+		{"/m/a", "1:", nil, true, true},
+		{"/m/a", "0", []string{"/m/b", "/m/c"}, false, true},
+		{"/m/a", "0:2", []string{"/m/c"}, false, true},
+		{"/m/a", "3", nil, true, false},
+		{"", "0", []string{"/m/c"}, false, true},
+		{"", "0:0", []string{"/m/b", "/m/c"}, false, true},
+		{"", "1:9", []string{"/m/b"}, false, true},
+	}
+
+	for _, test := range tests {
+		p := newMPDPlayer(t, test.current, "/m/b", "/m/c")
+		err := p.mpdCommand([]string{"delete", test.arg}, new(bytes.Buffer))
+		if (err == nil) != test.ok {
+			t.Errorf("delete %s with current %q: error %v",
+			         test.arg, test.current, err)
+			continue
+		} else if !test.ok {
+			continue
+		}
+
+		upcoming := p.readUpcoming()
+		if !reflect.DeepEqual(upcoming, test.upcoming) {
+			t.Errorf("delete %s with current %q: upcoming %v, want %v",
+			         test.arg, test.current, upcoming, test.upcoming)
+		}
+		if p.currentQueued() != test.kept {
+			t.Errorf("delete %s with current %q: current queued %v, want %v",
+			         test.arg, test.current, p.currentQueued(), test.kept)
+		}
+	}
+}
+
+func TestMPDPlayBounds(t *testing.T) {
+	tests := []struct {
+		current string
+		upcoming []string
+		arg string
+	}{
+		{"/m/a", nil, "1"},
+		{"", nil, "0"},
+		{"", []string{"/m/b"}, "1"},
+		{"/m/a", []string{"/m/b"}, "-1"},
+		{"/m/a", []string{"/m/b"}, "0:"},
+		{"/m/a", []string{"/m/b"}, "x"},
+	}
+
+	for _, test := range tests {
+		p := newMPDPlayer(t, test.current, test.upcoming...)
+		err := p.mpdCommand([]string{"play", test.arg}, new(bytes.Buffer))
+		if err == nil {
+			t.Errorf("play %s with %d queued: no error",
+			         test.arg, len(p.mpdQueue()))
+		}
+	}
+
+	p := newMPDPlayer(t, "", "/m/b")
+	p.mpd = &mpdQueue{version: 1, nextID: 1}
+	if err := p.mpdPlay(1); err == nil {
+		t.Error("mpdPlay past the end of upcoming: no error")
+	}
+}
+
+func TestMPDAdd(t *testing.T) {
+	SetAudioTypes(DefaultAudioTypes)
+	p := newMPDPlayer(t, "", "/m/b")
+	lib := p.tmpDir + "/lib"
+	for _, name := range []string{"x/2.mp3", "x/1.flac", "y.mp3", "cover.jpg"} {
+		os.MkdirAll(lib + "/x", 0700)
+		ioutil.WriteFile(lib + "/" + name, nil, 0600)
+	}
+
+	err := p.mpdCommand([]string{"addid", lib}, new(bytes.Buffer))
+	if err == nil {
+		t.Error("addid took a directory")
+	}
+	if upcoming := p.readUpcoming(); len(upcoming) != 1 {
+		t.Errorf("addid of a directory changed upcoming to %v", upcoming)
+	}
+
+	out := new(bytes.Buffer)
+	err = p.mpdCommand([]string{"addid", lib + "/y.mp3", "0"}, out)
+	if err != nil || !strings.HasPrefix(out.String(), "Id: ") {
+		t.Errorf("addid of a file: %q, %v", out.String(), err)
+	}
+
+	err = p.mpdCommand([]string{"add", lib}, new(bytes.Buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{lib + "/y.mp3", "/m/b", lib + "/x/1.flac",
+	                 lib + "/x/2.mp3", lib + "/y.mp3"}
+	if upcoming := p.readUpcoming(); !reflect.DeepEqual(upcoming, want) {
+		t.Errorf("upcoming %v, want %v", upcoming, want)
+	}
+
+	err = p.mpdCommand([]string{"add", lib + "/none"}, new(bytes.Buffer))
+	if err == nil {
+		t.Error("add of a missing file: no error")
+	}
+}
+
+func TestNetListenLeavesFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mmusic-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := dir + "/notes.txt"
+	ioutil.WriteFile(name, []byte("keep me"), 0600)
+	if _, err := netListen(name); err == nil {
+		t.Error("listened in place of a regular file")
+	}
+	if data, _ := ioutil.ReadFile(name); string(data) != "keep me" {
+		t.Error("regular file was removed")
+	}
+
+	/* A socket from an earlier run is replaced. */
+	name = dir + "/socket"
+	for i := 0; i < 2; i++ {
+		l, err := netListen(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			/* Leave the socket file behind like a crash would. */
+			l.(interface{ SetUnlinkOnClose(bool) }).SetUnlinkOnClose(false)
+		}
+		l.Close()
+	}
+}
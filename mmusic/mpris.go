@@ -0,0 +1,488 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/godbus/dbus"
+	"github.com/godbus/dbus/introspect"
+)
+
+/* MPRIS, https://specifications.freedesktop.org/mpris-spec/latest/
+ * so media keys, desktop widgets and playerctl can control mmusic. It's
+ * on the session bus given by $DBUS_SESSION_BUS_ADDRESS, turn it off with
+ * -mpris=false. */
+
+const (
+	mprisName = "org.mpris.MediaPlayer2.mmusic"
+	mprisPath = dbus.ObjectPath("/org/mpris/MediaPlayer2")
+	mprisRootIface = "org.mpris.MediaPlayer2"
+	mprisPlayerIface = "org.mpris.MediaPlayer2.Player"
+	mprisNoTrack = dbus.ObjectPath("/org/mpris/MediaPlayer2/TrackList/NoTrack")
+)
+
+const mprisIntrospection = `
+<node>
+	<interface name="org.mpris.MediaPlayer2">
+		<method name="Raise"/>
+		<method name="Quit"/>
+		<property name="CanQuit" type="b" access="read"/>
+		<property name="CanRaise" type="b" access="read"/>
+		<property name="HasTrackList" type="b" access="read"/>
+		<property name="Identity" type="s" access="read"/>
+		<property name="SupportedUriSchemes" type="as" access="read"/>
+		<property name="SupportedMimeTypes" type="as" access="read"/>
+	</interface>
+	<interface name="org.mpris.MediaPlayer2.Player">
+		<method name="Next"/>
+		<method name="Previous"/>
+		<method name="Pause"/>
+		<method name="PlayPause"/>
+		<method name="Stop"/>
+		<method name="Play"/>
+		<method name="Seek">
+			<arg name="Offset" type="x" direction="in"/>
+		</method>
+		<method name="SetPosition">
+			<arg name="TrackId" type="o" direction="in"/>
+			<arg name="Position" type="x" direction="in"/>
+		</method>
+		<method name="OpenUri">
+			<arg name="Uri" type="s" direction="in"/>
+		</method>
+		<signal name="Seeked">
+			<arg name="Position" type="x"/>
+		</signal>
+		<property name="PlaybackStatus" type="s" access="read"/>
+		<property name="LoopStatus" type="s" access="readwrite"/>
+		<property name="Rate" type="d" access="readwrite"/>
+		<property name="Shuffle" type="b" access="readwrite"/>
+		<property name="Metadata" type="a{sv}" access="read"/>
+		<property name="Volume" type="d" access="readwrite"/>
+		<property name="Position" type="x" access="read"/>
+		<property name="MinimumRate" type="d" access="read"/>
+		<property name="MaximumRate" type="d" access="read"/>
+		<property name="CanGoNext" type="b" access="read"/>
+		<property name="CanGoPrevious" type="b" access="read"/>
+		<property name="CanPlay" type="b" access="read"/>
+		<property name="CanPause" type="b" access="read"/>
+		<property name="CanSeek" type="b" access="read"/>
+		<property name="CanControl" type="b" access="read"/>
+	</interface>` + introspect.IntrospectDataString + `
+</node>`
+
+type mpris struct {
+	p *Player
+	conn *dbus.Conn
+
+	/* Only touched from Run. The track id changes with each song. */
+	track *Song
+	trackNum int
+	seeks int
+
+	/* What was last sent in PropertiesChanged. */
+	last map[string]interface{}
+}
+
+/* The three objects exported, each gets the methods of its interface. */
+type mprisRoot struct {
+	m *mpris
+}
+
+type mprisPlayer struct {
+	m *mpris
+}
+
+type mprisProperties struct {
+	m *mpris
+}
+
+/* Called from main before Run. */
+func (p *Player) StartMPRIS() error {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return err
+	}
+
+	m := &mpris{p: p, conn: conn}
+	conn.Export(mprisRoot{m}, mprisPath, mprisRootIface)
+	/* Seek isn't called Seek here so it isn't mistaken for io.Seeker's. */
+	conn.ExportWithMap(mprisPlayer{m}, map[string]string{"SeekBy": "Seek"},
+	                   mprisPath, mprisPlayerIface)
+	conn.Export(mprisProperties{m}, mprisPath, "org.freedesktop.DBus.Properties")
+	conn.Export(introspect.Introspectable(mprisIntrospection), mprisPath,
+	            "org.freedesktop.DBus.Introspectable")
+
+	/* Another mmusic may have the name already. */
+	name := mprisName
+	reply, err := conn.RequestName(name, dbus.NameFlagDoNotQueue)
+	if err == nil && reply != dbus.RequestNameReplyPrimaryOwner {
+		name = fmt.Sprintf("%s.instance%d", mprisName, os.Getpid())
+		reply, err = conn.RequestName(name, dbus.NameFlagDoNotQueue)
+	}
+	if err != nil {
+		return err
+	} else if reply != dbus.RequestNameReplyPrimaryOwner {
+		return fmt.Errorf("couldn't get the name %s", name)
+	}
+
+	go m.watch(p.Subscribe())
+	return nil
+}
+
+func (m *mpris) trackID() dbus.ObjectPath {
+	p := m.p
+	if p.current == nil || p.stopped && p.finished {
+		return mprisNoTrack
+	}
+
+	if p.current != m.track {
+		m.track = p.current
+		m.trackNum++
+	}
+	return dbus.ObjectPath(fmt.Sprintf("/org/mmusic/track/%d", m.trackNum))
+}
+
+func (m *mpris) metadata() map[string]dbus.Variant {
+	p := m.p
+	id := m.trackID()
+	metadata := map[string]dbus.Variant{
+		"mpris:trackid": dbus.MakeVariant(id),
+	}
+	if id == mprisNoTrack {
+		return metadata
+	}
+
+	s := p.current
+	tags := Tags{}
+	for k, v := range p.index[s.Value] {
+		tags[k] = v
+	}
+	for k, v := range p.metadata {
+		tags[k] = v
+	}
+	if tags["title"] == "" && s.Title != "" {
+		tags["title"] = s.Title
+	}
+
+	metadata["xesam:url"] = dbus.MakeVariant(makeURI(s.Value))
+	if tags["title"] != "" {
+		metadata["xesam:title"] = dbus.MakeVariant(tags["title"])
+	}
+	if tags["artist"] != "" {
+		metadata["xesam:artist"] = dbus.MakeVariant([]string{tags["artist"]})
+	}
+	if tags["album"] != "" {
+		metadata["xesam:album"] = dbus.MakeVariant(tags["album"])
+	}
+	if tags["genre"] != "" {
+		metadata["xesam:genre"] = dbus.MakeVariant([]string{tags["genre"]})
+	}
+	track, err := strconv.Atoi(tags["track"])
+	if err == nil {
+		metadata["xesam:trackNumber"] = dbus.MakeVariant(int32(track))
+	}
+
+	duration := s.Duration
+	if !p.stopped {
+		_, d := p.Position()
+		if d > 0 {
+			duration = d
+		}
+	}
+	if duration > 0 {
+		metadata["mpris:length"] = dbus.MakeVariant(int64(duration / time.Microsecond))
+	}
+	return metadata
+}
+
+func (m *mpris) position() int64 {
+	if m.p.stopped {
+		return 0
+	}
+	position, _ := m.p.Position()
+	return int64(position / time.Microsecond)
+}
+
+/* The Player properties as they are now, must be called from Run. */
+func (m *mpris) playerProps() map[string]interface{} {
+	p := m.p
+
+	status := "Playing"
+	if p.stopped {
+		status = "Stopped"
+	} else if p.paused {
+		status = "Paused"
+	}
+
+	loop := "Playlist"
+	switch p.repeat {
+	case RepeatOne:
+		loop = "Track"
+	case RepeatOnce:
+		loop = "None"
+	}
+
+	volume := float64(p.volume) / 100
+	if p.muted {
+		volume = 0
+	}
+
+	return map[string]interface{}{
+		"PlaybackStatus": status,
+		"LoopStatus": loop,
+		"Rate": 1.0,
+		"Shuffle": p.random,
+		"Metadata": m.metadata(),
+		"Volume": volume,
+		"Position": m.position(),
+		"MinimumRate": 1.0,
+		"MaximumRate": 1.0,
+		"CanGoNext": true,
+		"CanGoPrevious": true,
+		"CanPlay": true,
+		"CanPause": true,
+		"CanSeek": true,
+		"CanControl": true,
+	}
+}
+
+func (m *mpris) rootProps() map[string]interface{} {
+	return map[string]interface{}{
+		"CanQuit": true,
+		"CanRaise": false,
+		"HasTrackList": false,
+		"Identity": "mmusic",
+		"SupportedUriSchemes": []string{"file", "http", "https"},
+		"SupportedMimeTypes": []string{},
+	}
+}
+
+func (m *mpris) props(iface string) (map[string]interface{}, *dbus.Error) {
+	var props map[string]interface{}
+	switch iface {
+	case mprisRootIface:
+		props = m.rootProps()
+	case mprisPlayerIface:
+		m.p.Call(func() {
+			props = m.playerProps()
+		})
+	default:
+		return nil, dbus.NewError("org.freedesktop.DBus.Error.UnknownInterface",
+		                          []interface{}{iface})
+	}
+	return props, nil
+}
+
+/* Sends PropertiesChanged as things change, and Seeked after seeks. */
+func (m *mpris) watch(events chan string) {
+	for _ = range events {
+		var props map[string]interface{}
+		seeked := false
+		m.p.Call(func() {
+			props = m.playerProps()
+			if m.p.seeks != m.seeks {
+				m.seeks = m.p.seeks
+				seeked = true
+			}
+		})
+
+		changed := make(map[string]dbus.Variant)
+		for name, value := range props {
+			/* Clients work the position out for themselves. */
+			if name != "Position" && !reflect.DeepEqual(m.last[name], value) {
+				changed[name] = dbus.MakeVariant(value)
+			}
+		}
+		m.last = props
+
+		if len(changed) > 0 {
+			m.conn.Emit(mprisPath, "org.freedesktop.DBus.Properties.PropertiesChanged",
+			            mprisPlayerIface, changed, []string{})
+		}
+		if seeked {
+			m.conn.Emit(mprisPath, mprisPlayerIface + ".Seeked", props["Position"])
+		}
+	}
+}
+
+func (r mprisRoot) Raise() *dbus.Error {
+	return nil
+}
+
+func (r mprisRoot) Quit() *dbus.Error {
+	/* Reply first. */
+	go r.m.p.Call(r.m.p.Exit)
+	return nil
+}
+
+func (pl mprisPlayer) call(f func()) *dbus.Error {
+	pl.m.p.Call(f)
+	return nil
+}
+
+func (pl mprisPlayer) Next() *dbus.Error {
+	return pl.call(pl.m.p.PlayNext)
+}
+
+func (pl mprisPlayer) Previous() *dbus.Error {
+	return pl.call(pl.m.p.PlayPrev)
+}
+
+func (pl mprisPlayer) Pause() *dbus.Error {
+	return pl.call(pl.m.p.Pause)
+}
+
+func (pl mprisPlayer) PlayPause() *dbus.Error {
+	p := pl.m.p
+	return pl.call(func() {
+		if p.stopped || p.paused {
+			p.Start()
+		} else {
+			p.Pause()
+		}
+	})
+}
+
+func (pl mprisPlayer) Stop() *dbus.Error {
+	p := pl.m.p
+	return pl.call(func() {
+		if !p.stopped {
+			p.Stop(false)
+		}
+	})
+}
+
+func (pl mprisPlayer) Play() *dbus.Error {
+	return pl.call(pl.m.p.Start)
+}
+
+func (pl mprisPlayer) SeekBy(offset int64) *dbus.Error {
+	p := pl.m.p
+	return pl.call(func() {
+		if p.stopped {
+			return
+		}
+
+		position, duration := p.Position()
+		position += time.Duration(offset) * time.Microsecond
+		if duration > 0 && position > duration {
+			p.PlayNext()
+		} else {
+			p.Seek(position)
+		}
+	})
+}
+
+func (pl mprisPlayer) SetPosition(track dbus.ObjectPath, position int64) *dbus.Error {
+	m := pl.m
+	return pl.call(func() {
+		if m.p.stopped || track != m.trackID() {
+			return
+		}
+
+		_, duration := m.p.Position()
+		to := time.Duration(position) * time.Microsecond
+		if to >= 0 && (duration <= 0 || to <= duration) {
+			m.p.Seek(to)
+		}
+	})
+}
+
+func (pl mprisPlayer) OpenUri(uri string) *dbus.Error {
+	p := pl.m.p
+	value := uri
+	if strings.HasPrefix(uri, "file://") {
+		value = uri[len("file://"):]
+	}
+
+	return pl.call(func() {
+		s := p.findSong(value)
+		p.pushHistory(s)
+		p.Play(s)
+	})
+}
+
+func (x mprisProperties) Get(iface, name string) (dbus.Variant, *dbus.Error) {
+	props, err := x.m.props(iface)
+	if err != nil {
+		return dbus.Variant{}, err
+	}
+
+	value, ok := props[name]
+	if !ok {
+		return dbus.Variant{}, dbus.NewError("org.freedesktop.DBus.Error.UnknownProperty",
+		                                     []interface{}{name})
+	}
+	return dbus.MakeVariant(value), nil
+}
+
+func (x mprisProperties) GetAll(iface string) (map[string]dbus.Variant, *dbus.Error) {
+	props, err := x.m.props(iface)
+	if err != nil {
+		return nil, err
+	}
+
+	all := make(map[string]dbus.Variant)
+	for name, value := range props {
+		all[name] = dbus.MakeVariant(value)
+	}
+	return all, nil
+}
+
+func (x mprisProperties) Set(iface, name string, value dbus.Variant) *dbus.Error {
+	p := x.m.p
+	invalid := dbus.NewError("org.freedesktop.DBus.Error.InvalidArgs",
+	                         []interface{}{name})
+	if iface != mprisPlayerIface {
+		return dbus.NewError("org.freedesktop.DBus.Error.PropertyReadOnly",
+		                     []interface{}{name})
+	}
+
+	var err *dbus.Error
+	p.Call(func() {
+		switch name {
+		case "Volume":
+			volume, ok := value.Value().(float64)
+			if !ok {
+				err = invalid
+				return
+			}
+			p.Unmute()
+			p.SetVolume(int(volume * 100 + 0.5))
+		case "LoopStatus":
+			switch value.Value() {
+			case "None":
+				p.SetRepeat(RepeatOnce)
+			case "Track":
+				p.SetRepeat(RepeatOne)
+			case "Playlist":
+				p.SetRepeat(RepeatAll)
+			default:
+				err = invalid
+			}
+		case "Shuffle":
+			random, ok := value.Value().(bool)
+			if !ok {
+				err = invalid
+			} else if random {
+				p.SetModeRandom()
+			} else {
+				p.SetModeNormal()
+			}
+		case "Rate":
+			/* Only 1.0 is supported, there's nothing to change. */
+			rate, ok := value.Value().(float64)
+			if !ok || rate != 1.0 {
+				err = invalid
+			}
+		default:
+			err = dbus.NewError("org.freedesktop.DBus.Error.PropertyReadOnly",
+			                    []interface{}{name})
+		}
+	})
+	return err
+}
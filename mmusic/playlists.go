@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Reading and writing extended M3U, PLS and XSPF playlists. Entries
+ * keep any title and duration the playlist gives them, and relative
+ * paths are taken to be relative to the playlist. */
+
+const (
+	FormatPlain = ""
+	FormatM3U = "m3u"
+	FormatPLS = "pls"
+	FormatXSPF = "xspf"
+)
+
+/* Works out the format from the name or the start of the file, leaving
+ * file at the start again. */
+func playlistFormat(file *os.File) string {
+	switch strings.ToLower(path.Ext(file.Name())) {
+	case ".m3u", ".m3u8":
+		return FormatM3U
+	case ".pls":
+		return FormatPLS
+	case ".xspf":
+		return FormatXSPF
+	}
+
+	head := make([]byte, 512)
+	n, _ := file.Read(head)
+	file.Seek(0, 0)
+	head = bytes.TrimSpace(head[:n])
+
+	switch {
+	case bytes.HasPrefix(head, []byte("#EXTM3U")):
+		return FormatM3U
+	case bytes.HasPrefix(bytes.ToLower(head), []byte("[playlist]")):
+		return FormatPLS
+	case bytes.HasPrefix(head, []byte("<?xml")) &&
+	     bytes.Contains(head, []byte("<playlist")):
+		return FormatXSPF
+	}
+	return FormatPlain
+}
+
+/* Makes a playlist entry something we can play and expand. */
+func resolveEntry(dir string, value string) string {
+	if strings.HasPrefix(value, "file://") {
+		u, err := url.Parse(value)
+		if err == nil {
+			return u.Path
+		}
+		return value
+	} else if strings.Contains(value, "://") || strings.HasPrefix(value, "/") {
+		return value
+	}
+	return path.Join(dir, value)
+}
+
+func linkSongs(songs []*Song) *Song {
+	head := new(Song)
+	t := head
+	for _, s := range songs {
+		t.Next = s
+		t = s
+	}
+	t.Next = nil
+	return head.Next
+}
+
+func readM3U(data []byte, dir string) ([]*Song, []*Exclusion) {
+	var songs []*Song
+	var exclusions []*Exclusion
+	var title string
+	var duration time.Duration
+
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			/* #EXTINF:seconds,title */
+			info := line[len("#EXTINF:"):]
+			i := strings.Index(info, ",")
+			if i < 0 {
+				i = len(info)
+			} else {
+				title = strings.TrimSpace(info[i+1:])
+			}
+			/* There may be attributes after the length. */
+			fields := strings.Fields(info[:i])
+			if len(fields) > 0 {
+				secs, err := strconv.ParseFloat(fields[0], 64)
+				if err == nil && secs > 0 {
+					duration = time.Duration(secs * float64(time.Second))
+				}
+			}
+		case line[0] == '#':
+		case line[0] == '!':
+			e, err := ParseExclusion(line[1:])
+			if err == nil {
+				exclusions = append(exclusions, e)
+			}
+		default:
+			songs = append(songs, &Song{
+				Value: resolveEntry(dir, line),
+				Title: title,
+				Duration: duration,
+			})
+			title, duration = "", 0
+		}
+	}
+
+	return songs, exclusions
+}
+
+func readPLS(data []byte, dir string) []*Song {
+	entries := make(map[int]*Song)
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		i := strings.Index(line, "=")
+		if i < 0 {
+			continue
+		}
+		key, value := strings.ToLower(line[:i]), line[i+1:]
+
+		var field string
+		for _, f := range []string{"file", "title", "length"} {
+			if strings.HasPrefix(key, f) {
+				field = f
+				break
+			}
+		}
+		n, err := strconv.Atoi(key[len(field):])
+		if field == "" || err != nil {
+			continue
+		}
+
+		s := entries[n]
+		if s == nil {
+			s = new(Song)
+			entries[n] = s
+		}
+
+		switch field {
+		case "file":
+			s.Value = resolveEntry(dir, value)
+		case "title":
+			s.Title = value
+		case "length":
+			secs, err := strconv.Atoi(value)
+			if err == nil && secs > 0 {
+				s.Duration = time.Duration(secs) * time.Second
+			}
+		}
+	}
+
+	var nums []int
+	for n := range entries {
+		nums = append(nums, n)
+	}
+	sort.Ints(nums)
+
+	var songs []*Song
+	for _, n := range nums {
+		if entries[n].Value != "" {
+			songs = append(songs, entries[n])
+		}
+	}
+	return songs
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title string `xml:"title,omitempty"`
+	Creator string `xml:"creator,omitempty"`
+	/* milliseconds */
+	Duration int64 `xml:"duration,omitempty"`
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name `xml:"http://xspf.org/ns/0/ playlist"`
+	Version string `xml:"version,attr"`
+	Tracks []xspfTrack `xml:"trackList>track"`
+}
+
+func readXSPF(data []byte, dir string) ([]*Song, error) {
+	var playlist struct {
+		Tracks []xspfTrack `xml:"trackList>track"`
+	}
+
+	err := xml.Unmarshal(data, &playlist)
+	if err != nil {
+		return nil, err
+	}
+
+	var songs []*Song
+	for _, track := range playlist.Tracks {
+		if track.Location == "" {
+			continue
+		}
+
+		s := &Song{Value: resolveEntry(dir, strings.TrimSpace(track.Location))}
+		s.Title = track.Title
+		if track.Creator != "" && track.Title != "" {
+			s.Title = track.Creator + " - " + track.Title
+		}
+		s.Duration = time.Duration(track.Duration) * time.Millisecond
+		songs = append(songs, s)
+	}
+	return songs, nil
+}
+
+func readPlaylist(file *os.File, format string) (*Song, []*Exclusion) {
+	var songs []*Song
+	var exclusions []*Exclusion
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		log.Println(file.Name() + ":", err)
+		return nil, nil
+	}
+
+	dir := path.Dir(file.Name())
+	switch format {
+	case FormatM3U:
+		songs, exclusions = readM3U(data, dir)
+	case FormatPLS:
+		songs = readPLS(data, dir)
+	case FormatXSPF:
+		songs, err = readXSPF(data, dir)
+		if err != nil {
+			log.Println(file.Name() + ":", err)
+		}
+	}
+
+	return linkSongs(songs), exclusions
+}
+
+/* A title for writing out, from the playlist it came from or its tags
+ * if we have them. */
+func (p *Player) songTitle(s *Song) string {
+	if s.Title != "" {
+		return s.Title
+	}
+
+	tags := p.index[s.Value]
+	if tags["artist"] != "" && tags["title"] != "" {
+		return tags["artist"] + " - " + tags["title"]
+	} else if tags["title"] != "" {
+		return tags["title"]
+	}
+	return ""
+}
+
+/* Paths relative to where we were started are made absolute so saved
+ * playlists work from anywhere. */
+func absValue(value string) string {
+	if strings.Contains(value, "://") || strings.HasPrefix(value, "/") {
+		return value
+	}
+	return os.Getenv("PWD") + "/" + value
+}
+
+/* makeURI with the path escaped. */
+func escapedURI(value string) string {
+	if strings.Contains(value, "://") {
+		return value
+	}
+
+	uri := makeURI(value)
+	u := url.URL{Scheme: "file", Path: uri[len("file://"):]}
+	return u.String()
+}
+
+func (p *Player) writeM3U(songs []*Song) []byte {
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	for _, s := range songs {
+		secs := int64(-1)
+		if s.Duration > 0 {
+			secs = int64(s.Duration.Seconds())
+		}
+		title := p.songTitle(s)
+		if title == "" {
+			title = path.Base(s.Value)
+		}
+
+		fmt.Fprintf(&b, "#EXTINF:%d,%s\n%s\n", secs, title, absValue(s.Value))
+	}
+	return b.Bytes()
+}
+
+func (p *Player) writePLS(songs []*Song) []byte {
+	var b bytes.Buffer
+	b.WriteString("[playlist]\n")
+	for i, s := range songs {
+		fmt.Fprintf(&b, "File%d=%s\n", i + 1, absValue(s.Value))
+		title := p.songTitle(s)
+		if title != "" {
+			fmt.Fprintf(&b, "Title%d=%s\n", i + 1, title)
+		}
+		secs := int64(-1)
+		if s.Duration > 0 {
+			secs = int64(s.Duration.Seconds())
+		}
+		fmt.Fprintf(&b, "Length%d=%d\n", i + 1, secs)
+	}
+	fmt.Fprintf(&b, "NumberOfEntries=%d\nVersion=2\n", len(songs))
+	return b.Bytes()
+}
+
+func (p *Player) writeXSPF(songs []*Song) ([]byte, error) {
+	playlist := xspfPlaylist{Version: "1"}
+	for _, s := range songs {
+		track := xspfTrack{Location: escapedURI(s.Value)}
+		tags := p.index[s.Value]
+		if tags["title"] != "" {
+			track.Title = tags["title"]
+			track.Creator = tags["artist"]
+		} else {
+			track.Title = s.Title
+		}
+		track.Duration = int64(s.Duration / time.Millisecond)
+		playlist.Tracks = append(playlist.Tracks, track)
+	}
+
+	data, err := xml.MarshalIndent(playlist, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(data, '\n')...), nil
+}
+
+/* The songs in upcoming, with what we know about them from the
+ * library. */
+func (p *Player) upcomingSongs() []*Song {
+	data, err := ioutil.ReadFile(p.tmpDir + SuffixUpcoming)
+	if err != nil {
+		return nil
+	}
+
+	library := make(map[string]*Song)
+	for s := p.songs.Next; s != nil; s = s.Next {
+		library[s.Value] = s
+	}
+
+	var songs []*Song
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		s := library[line]
+		if s == nil {
+			s = &Song{Value: line}
+		}
+		songs = append(songs, s)
+	}
+	return songs
+}
+
+/* Writes the library ("playlist") or the upcoming queue ("upcoming") to
+ * name, in the format its extension gives or one path per line. */
+func (p *Player) SavePlaylist(which string, name string) error {
+	var songs []*Song
+	var data []byte
+	var err error
+
+	switch which {
+	case "playlist":
+		for s := p.songs.Next; s != nil; s = s.Next {
+			songs = append(songs, s)
+		}
+	case "upcoming":
+		songs = p.upcomingSongs()
+	default:
+		return fmt.Errorf("save: can't save %q, only playlist or upcoming", which)
+	}
+
+	switch strings.ToLower(path.Ext(name)) {
+	case ".m3u", ".m3u8":
+		data = p.writeM3U(songs)
+	case ".pls":
+		data = p.writePLS(songs)
+	case ".xspf":
+		data, err = p.writeXSPF(songs)
+	default:
+		var b bytes.Buffer
+		for _, s := range songs {
+			b.WriteString(absValue(s.Value) + "\n")
+		}
+		data = b.Bytes()
+	}
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(name, data, 0644)
+}
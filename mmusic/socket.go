@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+/* Commands over a unix socket in tmp, one JSON object per line such as
+ *
+ *     {"command": "seek", "args": ["+10"]}
+ *
+ * each answered with
+ *
+ *     {"status": "ok"} or {"status": "error", "error": "..."}
+ *
+ * and any "id" given in the command copied to the reply. The commands are
+ * the same as the ones read from in. */
+
+type socketRequest struct {
+	ID interface{} `json:"id,omitempty"`
+	Command string `json:"command"`
+	Args []string `json:"args"`
+}
+
+type socketReply struct {
+	ID interface{} `json:"id,omitempty"`
+	Status string `json:"status"`
+	Error string `json:"error,omitempty"`
+}
+
+/* Runs f in Run's goroutine, returning once it has. Everything that
+ * touches the player from other goroutines goes through here. */
+func (p *Player) Call(f func()) {
+	done := make(chan bool)
+	p.calls <- func() {
+		f()
+		close(done)
+	}
+	<-done
+}
+
+/* Listens on a unix socket if addr is a path, otherwise on tcp. */
+func netListen(addr string) (net.Listener, error) {
+	if strings.Contains(addr, "/") {
+		/* A socket left by an earlier run, but nothing else. */
+		fi, err := os.Lstat(addr)
+		if err == nil && fi.Mode() & os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", addr)
+		} else if err == nil {
+			os.Remove(addr)
+		}
+		return net.Listen("unix", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+func (p *Player) listenSocket() error {
+	listener, err := net.Listen("unix", p.tmpDir + SuffixSocket)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Println("socket:", err)
+				return
+			}
+			go p.serveSocket(conn)
+		}
+	}()
+	return nil
+}
+
+func (p *Player) serveSocket(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	encoder := json.NewEncoder(conn)
+
+	for scanner.Scan() {
+		var req socketRequest
+		reply := socketReply{Status: "ok"}
+
+		err := json.Unmarshal(scanner.Bytes(), &req)
+		if err == nil && req.Command == "" {
+			err = errors.New("no command")
+		}
+
+		if err == nil && req.Command == "exit" {
+			/* There won't be anyone left to reply after. */
+			encoder.Encode(socketReply{ID: req.ID, Status: "ok"})
+		}
+
+		if err == nil {
+			reply.ID = req.ID
+			p.Call(func() {
+				err = doFunction(p, append([]string{req.Command}, req.Args...))
+			})
+		}
+
+		if err != nil {
+			reply.Status = "error"
+			reply.Error = err.Error()
+		}
+
+		err = encoder.Encode(reply)
+		if err != nil {
+			return
+		}
+	}
+}
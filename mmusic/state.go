@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* What was playing and how, saved on exit so -resume can carry on
+ * where we left off. One key=value per line, with a line for each song
+ * in upcoming:
+ *
+ *     current=/media/music/a.flac
+ *     position=83000
+ *     state=play
+ *     random=true
+ *     repeat=all
+ *     volume=80
+ *     muted=false
+ *     crossfade=0
+ *     upcoming=/media/music/b.flac
+ *
+ * position is in milliseconds, state is "play", "pause" or "stop". */
+
+func defaultStatePath() string {
+	dir := os.Getenv("XDG_DATA_HOME")
+	if dir == "" {
+		dir = os.Getenv("HOME") + "/.local/share"
+	}
+	return dir + "/mmusic/state"
+}
+
+var repeatNames = map[int]string{
+	RepeatAll: "all",
+	RepeatOne: "one",
+	RepeatOnce: "once",
+}
+
+func (p *Player) SaveState(name string) error {
+	var lines []string
+	add := func(key string, value interface{}) {
+		lines = append(lines, fmt.Sprintf("%s=%v", key, value))
+	}
+
+	if p.current != nil {
+		state := "play"
+		if p.stopped {
+			state = "stop"
+		} else if p.paused {
+			state = "pause"
+		}
+
+		position, _ := p.Position()
+		if p.stopped {
+			position = 0
+		}
+		add("current", p.current.Value)
+		add("position", int64(position / time.Millisecond))
+		add("state", state)
+	}
+	add("random", p.random)
+	add("repeat", repeatNames[p.repeat])
+	add("volume", p.volume)
+	add("muted", p.muted)
+	add("crossfade", p.crossfade)
+	for _, s := range p.upcomingSongs() {
+		add("upcoming", s.Value)
+	}
+
+	err := os.MkdirAll(path.Dir(name), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := name + ".tmp"
+	err = ioutil.WriteFile(tmpPath, []byte(strings.Join(lines, "\n") + "\n"), 0600)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, name)
+}
+
+/* Sets the modes and upcoming from the state saved in name and starts
+ * the song that was playing. Call once the library is loaded, in place
+ * of the first PlayNext. */
+func (p *Player) RestoreState(name string) error {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	var current, state string
+	var position time.Duration
+	var upcoming []string
+	for _, line := range strings.Split(string(data), "\n") {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		key, value := kv[0], kv[1]
+		switch key {
+		case "current":
+			current = value
+		case "position":
+			ms, err := strconv.ParseInt(value, 10, 64)
+			if err == nil {
+				position = time.Duration(ms) * time.Millisecond
+			}
+		case "state":
+			state = value
+		case "random":
+			if value == "true" {
+				p.SetModeRandom()
+			} else {
+				p.SetModeNormal()
+			}
+		case "repeat":
+			for mode, name := range repeatNames {
+				if name == value {
+					p.SetRepeat(mode)
+				}
+			}
+		case "volume":
+			volume, err := strconv.Atoi(value)
+			if err == nil {
+				p.SetVolume(volume)
+			}
+		case "muted":
+			if value == "true" {
+				p.Mute()
+			}
+		case "crossfade":
+			secs, err := strconv.Atoi(value)
+			if err == nil {
+				p.SetCrossfade(secs)
+			}
+		case "upcoming":
+			upcoming = append(upcoming, value)
+		default:
+			log.Printf("state: unknown key %q", key)
+		}
+	}
+	writeLinesToValue(p.tmpDir + SuffixUpcoming, upcoming)
+
+	if current == "" {
+		p.PlayNext()
+		return nil
+	}
+
+	var s *Song
+	for t := p.songs.Next; t != nil; t = t.Next {
+		if t.Value == current {
+			s = t
+			break
+		}
+	}
+	if s == nil {
+		s = &Song{Value: current}
+	}
+
+	/* Seeking has to wait until the song has prerolled, see
+	 * handleMessage. */
+	p.resume = s
+	p.resumeAt = position
+	switch state {
+	case "stop":
+		p.current = s
+		p.Stop(false)
+	case "pause":
+		p.Play(s)
+		p.Pause()
+	default:
+		p.Play(s)
+	}
+	return nil
+}
+
+/* Seeks to where a restored song was, once it can be. */
+func (p *Player) checkResume() {
+	if p.resume == nil {
+		return
+	}
+
+	if p.resume == p.current && !p.stopped {
+		if p.resumeAt > 0 {
+			p.Seek(p.resumeAt)
+		}
+		p.resume = nil
+	} else if p.resume != p.current {
+		p.resume = nil
+	}
+}
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+/* Reading tags straight from files so the whole library can be indexed
+ * without gstreamer. Handles ID3v1 and ID3v2 (mp3), Vorbis comments
+ * (Ogg Vorbis/Opus/FLAC and native FLAC) and MP4 atoms (m4a). Only the
+ * title, artist, album, track and genre are read. */
+
+var ErrNoTags = errors.New("no tags found")
+
+/* Anything bigger than this is not worth reading for a few strings. */
+var MaxTagSize int64 = 16 * 1024 * 1024
+
+var id3v1Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk",
+	"Grunge", "Hip-Hop", "Jazz", "Metal", "New Age", "Oldies", "Other",
+	"Pop", "R&B", "Rap", "Reggae", "Rock", "Techno", "Industrial",
+	"Alternative", "Ska", "Death Metal", "Pranks", "Soundtrack",
+	"Euro-Techno", "Ambient", "Trip-Hop", "Vocal", "Jazz+Funk", "Fusion",
+	"Trance", "Classical", "Instrumental", "Acid", "House", "Game",
+	"Sound Clip", "Gospel", "Noise", "AlternRock", "Bass", "Soul", "Punk",
+	"Space", "Meditative", "Instrumental Pop", "Instrumental Rock",
+	"Ethnic", "Gothic", "Darkwave", "Techno-Industrial", "Electronic",
+	"Pop-Folk", "Eurodance", "Dream", "Southern Rock", "Comedy", "Cult",
+	"Gangsta", "Top 40", "Christian Rap", "Pop/Funk", "Jungle",
+	"Native American", "Cabaret", "New Wave", "Psychadelic", "Rave",
+	"Showtunes", "Trailer", "Lo-Fi", "Tribal", "Acid Punk", "Acid Jazz",
+	"Polka", "Retro", "Musical", "Rock & Roll", "Hard Rock",
+}
+
+func ReadTags(path string) (Tags, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	head := make([]byte, 12)
+	n, err := io.ReadFull(file, head)
+	if err != nil && n < 4 {
+		return nil, ErrNoTags
+	}
+
+	tags := make(Tags)
+	switch {
+	case bytes.HasPrefix(head, []byte("ID3")):
+		err = readID3v2(file, tags)
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		err = readFLAC(file, tags)
+	case bytes.HasPrefix(head, []byte("OggS")):
+		err = readOgg(file, tags)
+	case n >= 8 && bytes.Equal(head[4:8], []byte("ftyp")):
+		err = readMP4(file, tags)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	/* Fill in anything missing from an ID3v1 tag at the end. */
+	readID3v1(file, tags)
+
+	if len(tags) == 0 {
+		return nil, ErrNoTags
+	}
+	return tags, nil
+}
+
+func setTag(tags Tags, name string, value string) {
+	value = strings.TrimSpace(strings.TrimRight(value, "\x00"))
+	if value == "" {
+		return
+	}
+
+	switch name {
+	case "track":
+		/* "3/12" */
+		if i := strings.Index(value, "/"); i >= 0 {
+			value = value[:i]
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return
+		}
+		value = strconv.Itoa(n)
+	case "genre":
+		value = genreName(value)
+	}
+
+	if _, ok := tags[name]; !ok {
+		tags[name] = value
+	}
+}
+
+/* ID3v2 genres may be given as "(17)", "17" or "(17)Rock". */
+func genreName(value string) string {
+	num := value
+	if strings.HasPrefix(num, "(") {
+		i := strings.Index(num, ")")
+		if i < 0 {
+			return value
+		} else if i + 1 < len(num) {
+			return num[i+1:]
+		}
+		num = num[1:i]
+	}
+
+	n, err := strconv.Atoi(num)
+	if err != nil || n < 0 {
+		return value
+	} else if n < len(id3v1Genres) {
+		return id3v1Genres[n]
+	}
+	return value
+}
+
+func readID3v1(file *os.File, tags Tags) {
+	data := make([]byte, 128)
+	_, err := file.Seek(-128, io.SeekEnd)
+	if err != nil {
+		return
+	}
+	_, err = io.ReadFull(file, data)
+	if err != nil || !bytes.HasPrefix(data, []byte("TAG")) {
+		return
+	}
+
+	setTag(tags, "title", latin1(data[3:33]))
+	setTag(tags, "artist", latin1(data[33:63]))
+	setTag(tags, "album", latin1(data[63:93]))
+	/* ID3v1.1 puts the track in the end of the comment. */
+	if data[125] == 0 && data[126] != 0 {
+		setTag(tags, "track", strconv.Itoa(int(data[126])))
+	}
+	if int(data[127]) < len(id3v1Genres) {
+		setTag(tags, "genre", id3v1Genres[data[127]])
+	}
+}
+
+func syncsafe(b []byte) int64 {
+	return int64(b[0] & 0x7f) << 21 | int64(b[1] & 0x7f) << 14 |
+		int64(b[2] & 0x7f) << 7 | int64(b[3] & 0x7f)
+}
+
+/* Undoes unsynchronisation, 0xff 0x00 becomes 0xff. */
+func unsync(data []byte) []byte {
+	return bytes.Replace(data, []byte{0xff, 0x00}, []byte{0xff}, -1)
+}
+
+var id3v2Frames = map[string]string{
+	"TT2": "title", "TIT2": "title",
+	"TP1": "artist", "TPE1": "artist",
+	"TAL": "album", "TALB": "album",
+	"TRK": "track", "TRCK": "track",
+	"TCO": "genre", "TCON": "genre",
+}
+
+func readID3v2(file *os.File, tags Tags) error {
+	header := make([]byte, 10)
+	_, err := file.ReadAt(header, 0)
+	if err != nil {
+		return err
+	}
+
+	version := header[3]
+	flags := header[5]
+	size := syncsafe(header[6:10])
+	if version < 2 || version > 4 || size > MaxTagSize {
+		return nil
+	}
+
+	data := make([]byte, size)
+	_, err = file.ReadAt(data, 10)
+	if err != nil {
+		return nil
+	}
+
+	if version < 4 && flags & 0x80 != 0 {
+		data = unsync(data)
+	}
+
+	if flags & 0x40 != 0 && len(data) >= 4 {
+		/* Skip the extended header. */
+		var ext int64
+		if version == 3 {
+			ext = int64(binary.BigEndian.Uint32(data)) + 4
+		} else {
+			ext = syncsafe(data)
+		}
+		if ext > int64(len(data)) {
+			return nil
+		}
+		data = data[ext:]
+	}
+
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+
+	for len(data) >= headerLen && data[0] != 0 {
+		id := string(data[:idLen])
+		var frameSize int64
+		var frameFlags byte
+		switch version {
+		case 2:
+			frameSize = int64(data[3]) << 16 | int64(data[4]) << 8 |
+				int64(data[5])
+		case 3:
+			frameSize = int64(binary.BigEndian.Uint32(data[4:8]))
+			frameFlags = data[9]
+		case 4:
+			frameSize = syncsafe(data[4:8])
+			frameFlags = data[9]
+		}
+
+		if frameSize > int64(len(data) - headerLen) {
+			break
+		}
+		frame := data[headerLen:int64(headerLen) + frameSize]
+		data = data[int64(headerLen) + frameSize:]
+
+		name, ok := id3v2Frames[id]
+		if !ok {
+			continue
+		}
+
+		/* Compressed or encrypted, not worth it. */
+		if (version == 3 && frameFlags & 0xc0 != 0) ||
+		   (version == 4 && frameFlags & 0x0c != 0) {
+			continue
+		}
+
+		if version == 4 {
+			if frameFlags & 0x01 != 0 && len(frame) >= 4 {
+				frame = frame[4:]
+			}
+			if frameFlags & 0x02 != 0 {
+				frame = unsync(frame)
+			}
+		}
+
+		setTag(tags, name, id3v2Text(frame))
+	}
+
+	return nil
+}
+
+func latin1(b []byte) string {
+	runes := make([]rune, 0, len(b))
+	for _, c := range b {
+		if c == 0 {
+			break
+		}
+		runes = append(runes, rune(c))
+	}
+	return string(runes)
+}
+
+func decodeUTF16(b []byte, order binary.ByteOrder) string {
+	u := make([]uint16, 0, len(b) / 2)
+	for i := 0; i + 1 < len(b); i += 2 {
+		c := order.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
+
+/* The first byte of a text frame gives the encoding. */
+func id3v2Text(frame []byte) string {
+	if len(frame) < 2 {
+		return ""
+	}
+
+	text := frame[1:]
+	switch frame[0] {
+	case 0:
+		return latin1(text)
+	case 1:
+		if len(text) < 2 {
+			return ""
+		} else if text[0] == 0xfe && text[1] == 0xff {
+			return decodeUTF16(text[2:], binary.BigEndian)
+		} else if text[0] == 0xff && text[1] == 0xfe {
+			return decodeUTF16(text[2:], binary.LittleEndian)
+		}
+		return decodeUTF16(text, binary.LittleEndian)
+	case 2:
+		return decodeUTF16(text, binary.BigEndian)
+	case 3:
+		if i := bytes.IndexByte(text, 0); i >= 0 {
+			text = text[:i]
+		}
+		return string(text)
+	}
+	return ""
+}
+
+var vorbisFields = map[string]string{
+	"TITLE": "title",
+	"ARTIST": "artist",
+	"ALBUM": "album",
+	"TRACKNUMBER": "track",
+	"GENRE": "genre",
+}
+
+func readVorbisComment(data []byte, tags Tags) {
+	if len(data) < 4 {
+		return
+	}
+	vendor := int64(binary.LittleEndian.Uint32(data))
+	if vendor + 8 > int64(len(data)) {
+		return
+	}
+	data = data[4 + vendor:]
+
+	count := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+	for i := uint32(0); i < count && len(data) >= 4; i++ {
+		length := int64(binary.LittleEndian.Uint32(data))
+		if length + 4 > int64(len(data)) {
+			return
+		}
+		comment := string(data[4:4 + length])
+		data = data[4 + length:]
+
+		j := strings.Index(comment, "=")
+		if j < 0 {
+			continue
+		}
+		name, ok := vorbisFields[strings.ToUpper(comment[:j])]
+		if ok {
+			setTag(tags, name, comment[j+1:])
+		}
+	}
+}
+
+func readFLAC(file *os.File, tags Tags) error {
+	header := make([]byte, 4)
+	offset := int64(4)
+	for {
+		_, err := file.ReadAt(header, offset)
+		if err != nil {
+			return nil
+		}
+
+		last := header[0] & 0x80 != 0
+		kind := header[0] & 0x7f
+		length := int64(header[1]) << 16 | int64(header[2]) << 8 |
+			int64(header[3])
+		offset += 4
+
+		if kind == 4 && length <= MaxTagSize {
+			data := make([]byte, length)
+			_, err = file.ReadAt(data, offset)
+			if err == nil {
+				readVorbisComment(data, tags)
+			}
+			return nil
+		}
+
+		if last {
+			return nil
+		}
+		offset += length
+	}
+}
+
+/* Reads the first n packets of the first stream in an ogg file. */
+func oggPackets(file *os.File, n int) [][]byte {
+	var packets [][]byte
+	var packet []byte
+	var serial []byte
+	var total int64
+
+	header := make([]byte, 27)
+	offset := int64(0)
+	for len(packets) < n {
+		_, err := file.ReadAt(header, offset)
+		if err != nil || !bytes.HasPrefix(header, []byte("OggS")) {
+			break
+		}
+
+		segments := make([]byte, header[26])
+		_, err = file.ReadAt(segments, offset + 27)
+		if err != nil {
+			break
+		}
+		offset += 27 + int64(len(segments))
+
+		var size int64
+		for _, s := range segments {
+			size += int64(s)
+		}
+		body := make([]byte, size)
+		_, err = file.ReadAt(body, offset)
+		if err != nil {
+			break
+		}
+		offset += size
+
+		/* Some other stream multiplexed in. */
+		if serial == nil {
+			serial = append([]byte{}, header[14:18]...)
+		} else if !bytes.Equal(serial, header[14:18]) {
+			continue
+		}
+
+		total += size
+		if total > MaxTagSize {
+			break
+		}
+
+		for _, s := range segments {
+			packet = append(packet, body[:s]...)
+			body = body[s:]
+			if s < 255 {
+				packets = append(packets, packet)
+				packet = nil
+			}
+		}
+	}
+
+	return packets
+}
+
+func readOgg(file *os.File, tags Tags) error {
+	packets := oggPackets(file, 2)
+	if len(packets) < 2 {
+		return nil
+	}
+
+	comment := packets[1]
+	switch {
+	case bytes.HasPrefix(comment, []byte("\x03vorbis")):
+		readVorbisComment(comment[7:], tags)
+	case bytes.HasPrefix(comment, []byte("OpusTags")):
+		readVorbisComment(comment[8:], tags)
+	case bytes.HasPrefix(packets[0], []byte("\x7fFLAC")) &&
+	     len(comment) > 4 && comment[0] & 0x7f == 4:
+		readVorbisComment(comment[4:], tags)
+	}
+	return nil
+}
+
+var mp4Items = map[string]string{
+	"\xa9nam": "title",
+	"\xa9ART": "artist",
+	"\xa9alb": "album",
+	"trkn": "track",
+	"\xa9gen": "genre",
+	"gnre": "genre",
+}
+
+/* Calls f with the type, offset and length of the contents of each
+ * atom between start and end. */
+func mp4Atoms(file *os.File, start, end int64,
+              f func(kind string, offset, length int64)) {
+	header := make([]byte, 16)
+	for start + 8 <= end {
+		_, err := file.ReadAt(header[:8], start)
+		if err != nil {
+			return
+		}
+
+		size := int64(binary.BigEndian.Uint32(header))
+		kind := string(header[4:8])
+		headerLen := int64(8)
+		if size == 1 {
+			_, err = file.ReadAt(header[8:16], start + 8)
+			if err != nil {
+				return
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerLen = 16
+		} else if size == 0 {
+			size = end - start
+		}
+
+		/* 64 bit sizes can be big enough for start + size to wrap. */
+		if size < headerLen || size > end - start {
+			return
+		}
+		f(kind, start + headerLen, size - headerLen)
+		start += size
+	}
+}
+
+func readMP4(file *os.File, tags Tags) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	var ilst, ilstLen int64 = -1, 0
+	var find func(path []string, kind string, offset, length int64)
+	find = func(path []string, kind string, offset, length int64) {
+		if kind != path[0] {
+			return
+		}
+		if len(path) == 1 {
+			ilst, ilstLen = offset, length
+			return
+		}
+		if kind == "meta" {
+			/* meta is a full atom, version and flags first. */
+			offset += 4
+			length -= 4
+		}
+		mp4Atoms(file, offset, offset + length,
+		         func(k string, o, l int64) { find(path[1:], k, o, l) })
+	}
+
+	path := []string{"moov", "udta", "meta", "ilst"}
+	mp4Atoms(file, 0, info.Size(), func(k string, o, l int64) {
+		find(path, k, o, l)
+	})
+	if ilst < 0 || ilstLen > MaxTagSize {
+		return nil
+	}
+
+	mp4Atoms(file, ilst, ilst + ilstLen, func(item string, o, l int64) {
+		name, ok := mp4Items[item]
+		if !ok {
+			return
+		}
+
+		mp4Atoms(file, o, o + l, func(k string, o, l int64) {
+			/* data atoms have 4 bytes of type and 4 of locale. */
+			if k != "data" || l < 8 || l - 8 > MaxTagSize {
+				return
+			}
+			data := make([]byte, l - 8)
+			_, err := file.ReadAt(data, o + 8)
+			if err != nil {
+				return
+			}
+
+			switch item {
+			case "trkn":
+				if len(data) >= 4 {
+					n := binary.BigEndian.Uint16(data[2:4])
+					setTag(tags, name, strconv.Itoa(int(n)))
+				}
+			case "gnre":
+				if len(data) >= 2 {
+					n := int(binary.BigEndian.Uint16(data)) - 1
+					if n >= 0 && n < len(id3v1Genres) {
+						setTag(tags, name, id3v1Genres[n])
+					}
+				}
+			default:
+				setTag(tags, name, string(data))
+			}
+		})
+	})
+
+	return nil
+}
+
+type indexResult struct {
+	gen int
+	index map[string]Tags
+}
+
+/* Reads the tags of everything in the library in the background, the
+ * result is handed to Run through p.indexed. */
+func (p *Player) IndexLibrary() {
+	var values []string
+	for s := p.songs.Next; s != nil; s = s.Next {
+		values = append(values, s.Value)
+	}
+
+	/* Only the latest index is kept if the library changes while an
+	 * older one is being built. */
+	p.indexGen++
+	gen := p.indexGen
+
+	go func() {
+		index := make(map[string]Tags)
+		for _, value := range values {
+			path := value
+			if strings.HasPrefix(path, "file://") {
+				path = path[len("file://"):]
+			} else if strings.Contains(path, "://") {
+				continue
+			}
+
+			tags, err := ReadTags(path)
+			if err == nil {
+				index[value] = tags
+			}
+		}
+
+		p.indexed <- &indexResult{gen, index}
+	}()
+}
+
+/* One line per song with tags, the path followed by tab separated
+ * key=value pairs. */
+func (p *Player) writeIndex() {
+	var data bytes.Buffer
+	clean := strings.NewReplacer("\t", " ", "\n", " ")
+
+	for s := p.songs.Next; s != nil; s = s.Next {
+		tags := p.index[s.Value]
+		if tags == nil {
+			continue
+		}
+
+		data.WriteString(s.Value)
+		for _, name := range TagNames {
+			value, ok := tags[name]
+			if ok {
+				data.WriteString("\t" + name + "=" + clean.Replace(value))
+			}
+		}
+		data.WriteString("\n")
+	}
+
+	writeStringToValue(p.tmpDir + SuffixIndex, data.String())
+}
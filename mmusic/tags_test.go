@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func be32(n int) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(n))
+	return b
+}
+
+func le32(n int) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(n))
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func vorbisComment(comments ...string) []byte {
+	data := concat(le32(4), []byte("test"), le32(len(comments)))
+	for _, c := range comments {
+		data = concat(data, le32(len(c)), []byte(c))
+	}
+	return data
+}
+
+func id3v2Frame(id string, text string) []byte {
+	body := concat([]byte{0}, []byte(text))
+	return concat([]byte(id), be32(len(body)), []byte{0, 0}, body)
+}
+
+func id3v2Tag(frames ...[]byte) []byte {
+	data := concat(frames...)
+	size := len(data)
+	header := []byte{'I', 'D', '3', 3, 0, 0,
+	                 byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f),
+	                 byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	return concat(header, data)
+}
+
+func id3v1Tag(title string, track byte, genre byte) []byte {
+	data := make([]byte, 128)
+	copy(data, "TAG")
+	copy(data[3:33], title)
+	data[126] = track
+	data[127] = genre
+	return data
+}
+
+func flacBlock(kind byte, last bool, data []byte) []byte {
+	if last {
+		kind |= 0x80
+	}
+	n := len(data)
+	return concat([]byte{kind, byte(n >> 16), byte(n >> 8), byte(n)}, data)
+}
+
+/* One page holding the packets, which must each fit in a segment. */
+func oggPage(serial int, packets ...[]byte) []byte {
+	header := make([]byte, 27)
+	copy(header, "OggS")
+	copy(header[14:18], le32(serial))
+	header[26] = byte(len(packets))
+
+	var segments []byte
+	for _, packet := range packets {
+		segments = append(segments, byte(len(packet)))
+	}
+	return concat(header, segments, concat(packets...))
+}
+
+func mp4Atom(kind string, parts ...[]byte) []byte {
+	data := concat(parts...)
+	return concat(be32(8 + len(data)), []byte(kind), data)
+}
+
+func mp4Item(kind string, data []byte) []byte {
+	return mp4Atom(kind, mp4Atom("data", make([]byte, 8), data))
+}
+
+func mp4File(items ...[]byte) []byte {
+	meta := mp4Atom("meta", make([]byte, 4), mp4Atom("ilst", items...))
+	return concat(mp4Atom("ftyp", []byte("M4A \x00\x00\x00\x00")),
+	              mp4Atom("moov", mp4Atom("udta", meta)))
+}
+
+func TestReadTags(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		tags Tags
+	}{
+		{"id3v2.mp3", id3v2Tag(id3v2Frame("TIT2", "Title"),
+		                       id3v2Frame("TPE1", "Artist"),
+		                       id3v2Frame("TRCK", "3/12"),
+		                       id3v2Frame("TCON", "(17)"),
+		                       id3v2Frame("COMM", "ignored")),
+		 Tags{"title": "Title", "artist": "Artist", "track": "3",
+		      "genre": "Rock"}},
+		/* ID3v1 only fills in what ID3v2 left out. */
+		{"both.mp3", concat(id3v2Tag(id3v2Frame("TIT2", "Title")),
+		                    make([]byte, 64), id3v1Tag("Other", 4, 8)),
+		 Tags{"title": "Title", "track": "4", "genre": "Jazz"}},
+		{"flac.flac",
+		 concat([]byte("fLaC"), flacBlock(0, false, make([]byte, 34)),
+		        flacBlock(4, true, vorbisComment("TITLE=Title",
+		                                         "album=Album", "NOPE"))),
+		 Tags{"title": "Title", "album": "Album"}},
+		{"vorbis.ogg",
+		 concat(oggPage(1, []byte("\x01vorbis")),
+		        oggPage(2, []byte("\x03vorbis junk")),
+		        oggPage(1, concat([]byte("\x03vorbis"),
+		                          vorbisComment("ARTIST=Artist",
+		                                        "TRACKNUMBER=7")))),
+		 Tags{"artist": "Artist", "track": "7"}},
+		{"opus.opus",
+		 oggPage(1, []byte("OpusHead"),
+		         concat([]byte("OpusTags"), vorbisComment("GENRE=Folk"))),
+		 Tags{"genre": "Folk"}},
+		{"mp4.m4a",
+		 /* gnre counts from 1, unlike ID3v1. */
+		 mp4File(mp4Item("\xa9nam", []byte("Title")),
+		         mp4Item("trkn", []byte{0, 0, 0, 5, 0, 9}),
+		         mp4Item("gnre", []byte{0, 9}),
+		         mp4Item("free", []byte("ignored"))),
+		 Tags{"title": "Title", "track": "5", "genre": "Jazz"}},
+	}
+
+	dir, err := ioutil.TempDir("", "mmusic-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range tests {
+		path := dir + "/" + test.name
+		ioutil.WriteFile(path, test.data, 0600)
+		tags, err := ReadTags(path)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !reflect.DeepEqual(tags, test.tags) {
+			t.Errorf("%s: tags %v, want %v", test.name, tags, test.tags)
+		}
+	}
+}
+
+func TestReadTagsBroken(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty.mp3", nil},
+		{"plain.mp3", []byte("not a tag at all")},
+		/* Frame sizes running past the end of the tag. */
+		{"short.mp3", id3v2Tag(concat([]byte("TIT2"), be32(1000),
+		                              []byte{0, 0, 0, 'x'}))},
+		{"short.flac", concat([]byte("fLaC"),
+		                      flacBlock(4, true, le32(1000)))},
+		{"short.ogg", concat(oggPage(1, []byte("\x01vorbis")),
+		                     []byte("OggS"))},
+		/* A 64 bit size that wraps when added to the offset. */
+		{"huge.m4a", concat(mp4Atom("ftyp", []byte("M4A ")),
+		                    be32(1), []byte("moov"),
+		                    []byte{0x7f, 0xff, 0xff, 0xff,
+		                           0xff, 0xff, 0xff, 0xff})},
+		{"nested.m4a", concat(mp4Atom("ftyp", []byte("M4A ")),
+		                      be32(16), []byte("moov"),
+		                      be32(1000), []byte("udta"))},
+	}
+
+	dir, err := ioutil.TempDir("", "mmusic-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range tests {
+		path := dir + "/" + test.name
+		ioutil.WriteFile(path, test.data, 0600)
+		tags, err := ReadTags(path)
+		if err != ErrNoTags {
+			t.Errorf("%s: tags %v, error %v, want %v",
+			         test.name, tags, err, ErrNoTags)
+		}
+	}
+}
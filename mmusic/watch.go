@@ -0,0 +1,199 @@
+package main
+
+import (
+	"log"
+	"path"
+	"strings"
+)
+
+/* Keeping the library up to date with the directories in it while
+ * running, with -w. Only directories that were expanded when scanning
+ * are watched, songs listed on their own in playlist files aren't. */
+
+type WatchEvent struct {
+	Path string
+	IsDir bool
+	/* Deleted or moved away, otherwise created, written or moved in. */
+	Removed bool
+}
+
+func (p *Player) StartWatching() error {
+	w, err := NewWatcher()
+	if err != nil {
+		return err
+	}
+	p.watcher = w
+	p.watchEvents = w.Events
+	return nil
+}
+
+/* Watches exactly dirs, dropping any watches on other directories. */
+func (p *Player) watchDirs(dirs []string) {
+	if p.watcher == nil {
+		return
+	}
+
+	keep := make(map[string]bool)
+	for _, dir := range dirs {
+		keep[dir] = true
+	}
+	for _, dir := range p.watcher.Watching() {
+		if !keep[dir] {
+			p.watcher.Remove(dir)
+		}
+	}
+
+	p.addWatches(dirs)
+}
+
+func (p *Player) addWatches(dirs []string) {
+	if p.watcher == nil {
+		return
+	}
+
+	for _, dir := range dirs {
+		err := p.watcher.Add(dir)
+		if err != nil {
+			log.Println("watch", dir + ":", err)
+		}
+	}
+}
+
+func (p *Player) watchChanged(e WatchEvent) {
+	changed := false
+	if e.Removed {
+		changed = p.removeSongs(e.Path, e.IsDir) > 0
+		if e.IsDir {
+			for _, dir := range p.watcher.Watching() {
+				if dir == e.Path || strings.HasPrefix(dir, e.Path + "/") {
+					p.watcher.Remove(dir)
+				}
+			}
+		}
+	} else if e.IsDir {
+		changed = p.addDir(e.Path) > 0
+	} else {
+		changed = p.addFile(e.Path)
+	}
+
+	if changed {
+		p.writePlaylist()
+		if p.indexing {
+			p.writeIndex()
+		}
+		p.notify(EventDatabase)
+	}
+}
+
+/* Watches dir and adds everything in it, returning how many songs were
+ * added. */
+func (p *Player) addDir(dir string) int {
+	err := p.watcher.Add(dir)
+	if err != nil {
+		log.Println("watch", dir + ":", err)
+	}
+
+	/* Not from the cache, it isn't ours to change from here. */
+	entries, err := listDir(dir)
+	if err != nil {
+		return 0
+	}
+
+	added := 0
+	for _, entry := range entries {
+		value := dir + "/" + entry.Name
+		if entry.IsDir {
+			added += p.addDir(value)
+		} else if p.addFile(value) {
+			added++
+		}
+	}
+	return added
+}
+
+/* Adds value if it is new and audio, or reads its tags again if it is
+ * already in the library. Returns whether anything changed. */
+func (p *Player) addFile(value string) bool {
+	exists := false
+	for s := p.songs.Next; s != nil; s = s.Next {
+		if s.Value == value {
+			exists = true
+			break
+		}
+	}
+
+	if !exists {
+		if !isAudio(value) {
+			return false
+		}
+		for _, e := range p.exclusions {
+			if e.Match(value) {
+				return false
+			}
+		}
+
+		s := &Song{Value: value}
+		p.insertSong(s)
+		p.size++
+
+		p.shuffleIn(s)
+		log.Println("added", value)
+	}
+
+	if p.indexing {
+		tags, err := ReadTags(value)
+		if err == nil {
+			if p.index == nil {
+				p.index = make(map[string]Tags)
+			}
+			p.index[value] = tags
+		}
+	}
+	return !exists || p.indexing
+}
+
+/* How many directories a and b have in common. */
+func commonDirs(a, b string) int {
+	as := strings.Split(path.Dir(a), "/")
+	bs := strings.Split(path.Dir(b), "/")
+	n := 0
+	for n < len(as) && n < len(bs) && as[n] == bs[n] {
+		n++
+	}
+	return n
+}
+
+/* Puts s next to the songs from the same directory, in order with them,
+ * as it would be if the library had been scanned again. */
+func (p *Player) insertSong(s *Song) {
+	after := p.songs
+	best := -1
+
+	for t := p.songs; t.Next != nil; t = t.Next {
+		u := t.Next
+		n := commonDirs(u.Value, s.Value)
+		if n > best {
+			best = n
+			if u.Value < s.Value {
+				after = u
+			} else {
+				after = t
+			}
+		} else if n == best && u.Value < s.Value {
+			after = u
+		}
+	}
+
+	s.Next = after.Next
+	after.Next = s
+}
+
+/* Removes value, or everything under it if it was a directory. */
+func (p *Player) removeSongs(value string, isDir bool) int {
+	return p.removeMatching(func(s *Song) bool {
+		if isDir {
+			return strings.HasPrefix(s.Value, value + "/")
+		}
+		return s.Value == value
+	})
+}
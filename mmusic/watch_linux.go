@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+/* Watches directories with inotify, sending what changes in them on
+ * Events. Directories aren't watched recursively, each has to be added. */
+type Watcher struct {
+	fd int
+	lock sync.Mutex
+	dirs map[int32]string
+	wds map[string]int32
+	Events chan WatchEvent
+}
+
+const watchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE |
+	syscall.IN_MOVED_TO | syscall.IN_DELETE | syscall.IN_MOVED_FROM |
+	syscall.IN_ONLYDIR
+
+func NewWatcher() (*Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{
+		fd: fd,
+		dirs: make(map[int32]string),
+		wds: make(map[string]int32),
+		Events: make(chan WatchEvent, 64),
+	}
+	go w.read()
+	return w, nil
+}
+
+func (w *Watcher) Add(dir string) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if _, ok := w.wds[dir]; ok {
+		return nil
+	}
+
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, watchMask)
+	if err != nil {
+		return err
+	}
+
+	/* The same directory by another name gets the same wd. */
+	if old, ok := w.dirs[int32(wd)]; ok {
+		delete(w.wds, old)
+	}
+	w.dirs[int32(wd)] = dir
+	w.wds[dir] = int32(wd)
+	return nil
+}
+
+func (w *Watcher) Remove(dir string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	wd, ok := w.wds[dir]
+	if !ok {
+		return
+	}
+	syscall.InotifyRmWatch(w.fd, uint32(wd))
+	delete(w.wds, dir)
+	delete(w.dirs, wd)
+}
+
+func (w *Watcher) Watching() []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	var dirs []string
+	for dir := range w.wds {
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+func (w *Watcher) read() {
+	buf := make([]byte, 64 * (syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1))
+
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			log.Println("watcher:", err)
+			return
+		}
+
+		for i := 0; i + syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[i]))
+			i += syscall.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buf[i:i + int(raw.Len)], "\x00"))
+			i += int(raw.Len)
+
+			w.handle(raw.Wd, raw.Mask, name)
+		}
+	}
+}
+
+func (w *Watcher) handle(wd int32, mask uint32, name string) {
+	if mask & syscall.IN_Q_OVERFLOW != 0 {
+		log.Println("watcher: too many changes at once, some were missed")
+		return
+	}
+
+	w.lock.Lock()
+	dir, ok := w.dirs[wd]
+	if ok && mask & syscall.IN_IGNORED != 0 {
+		delete(w.dirs, wd)
+		delete(w.wds, dir)
+	}
+	w.lock.Unlock()
+
+	if !ok || name == "" {
+		return
+	}
+
+	e := WatchEvent{
+		Path: dir + "/" + name,
+		IsDir: mask & syscall.IN_ISDIR != 0,
+		Removed: mask & (syscall.IN_DELETE | syscall.IN_MOVED_FROM) != 0,
+	}
+	w.Events <- e
+}
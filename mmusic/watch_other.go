@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+type Watcher struct {
+	Events chan WatchEvent
+}
+
+func NewWatcher() (*Watcher, error) {
+	return nil, errors.New("watching directories is only supported on linux")
+}
+
+func (w *Watcher) Add(dir string) error {
+	return nil
+}
+
+func (w *Watcher) Remove(dir string) {
+}
+
+func (w *Watcher) Watching() []string {
+	return nil
+}